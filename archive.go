@@ -0,0 +1,281 @@
+package tinykv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Archive layout:
+| OFFSET | SIZE | DATA
+|      0 |    4 | magic ("TKVA")
+|      4 |    4 | archive format version
+|      8 |    4 | page size
+|     12 |    4 | page count
+|     16 |      | blocks
+|        | 8*bc | offset of each block
+|        |    8 | offset of the block offsets
+|        |    4 | block count
+|        |    4 | magic ("TKVA")
+
+A block is a run of archiveBlockPages consecutive pages compressed with
+DEFLATE, the last one may be shorter. The block offsets come last so
+archives can be written to a stream.
+*/
+
+const (
+	archiveFormatVersion uint32 = 1
+	archiveBlockPages    uint32 = 16
+	archiveHeaderSize           = 16
+	archiveFooterSize           = 16
+)
+
+var archiveMagic = []byte("TKVA")
+
+// WriteArchive writes a compressed, read-only copy of the database to w,
+// which can be opened with OpenArchive. Pages are compressed in blocks,
+// so reading a page only decompresses its block.
+func (db *DB) WriteArchive(w io.Writer) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bp := db.bufferPool
+
+	err := bp.flush()
+	if err != nil {
+		return err
+	}
+
+	pageCount, err := bp.getPageCount()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, archiveHeaderSize)
+	copy(header[0:4], archiveMagic)
+	binary.LittleEndian.PutUint32(header[4:8], archiveFormatVersion)
+	binary.LittleEndian.PutUint32(header[8:12], defaultPageSize)
+	binary.LittleEndian.PutUint32(header[12:16], pageCount)
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	var compressed bytes.Buffer
+	compressor, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	var blockOffsets []uint64
+	offset := uint64(archiveHeaderSize)
+	buf := alignedBuffer(int(archiveBlockPages * defaultPageSize))
+	for firstPage := uint32(0); firstPage < pageCount; firstPage += archiveBlockPages {
+		data, err := readExtent(bp, buf, firstPage, pageCount)
+		if err != nil {
+			return err
+		}
+
+		compressed.Reset()
+		compressor.Reset(&compressed)
+		_, err = compressor.Write(data)
+		if err != nil {
+			return err
+		}
+		err = compressor.Close()
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(compressed.Bytes())
+		if err != nil {
+			return err
+		}
+		blockOffsets = append(blockOffsets, offset)
+		offset += uint64(compressed.Len())
+	}
+
+	footer := make([]byte, 8*len(blockOffsets)+archiveFooterSize)
+	for i, blockOffset := range blockOffsets {
+		binary.LittleEndian.PutUint64(footer[8*i:8*i+8], blockOffset)
+	}
+	tail := footer[8*len(blockOffsets):]
+	binary.LittleEndian.PutUint64(tail[0:8], offset)
+	binary.LittleEndian.PutUint32(tail[8:12], uint32(len(blockOffsets)))
+	copy(tail[12:16], archiveMagic)
+
+	_, err = w.Write(footer)
+	return err
+}
+
+// OpenArchive opens an archive written by WriteArchive. The database is
+// read-only.
+func OpenArchive(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store, err := newArchivePageStore(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return openDBWithStore(store, &Options{ReadOnly: true})
+}
+
+// archivePageStore reads pages from an archive, keeping the last block
+// it decompressed.
+type archivePageStore struct {
+	r            io.ReaderAt
+	pageCount    uint32
+	blockOffsets []uint64
+
+	cachedBlock int
+	cached      []byte
+}
+
+func newArchivePageStore(r io.ReaderAt, size int64) (*archivePageStore, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid archive: %s", reason)
+	}
+
+	if size < archiveHeaderSize+archiveFooterSize {
+		return nil, invalid("too short")
+	}
+
+	header := make([]byte, archiveHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:4], archiveMagic) {
+		return nil, invalid("bad magic")
+	}
+	if version := binary.LittleEndian.Uint32(header[4:8]); version != archiveFormatVersion {
+		return nil, invalid(fmt.Sprintf("unsupported format version %d", version))
+	}
+	if pageSize := binary.LittleEndian.Uint32(header[8:12]); pageSize != defaultPageSize {
+		return nil, invalid(fmt.Sprintf("page size %d, expected %d", pageSize, defaultPageSize))
+	}
+
+	tail := make([]byte, archiveFooterSize)
+	_, err = r.ReadAt(tail, size-archiveFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tail[12:16], archiveMagic) {
+		return nil, invalid("bad footer magic")
+	}
+
+	indexOffset := binary.LittleEndian.Uint64(tail[0:8])
+	blockCount := binary.LittleEndian.Uint32(tail[8:12])
+	if indexOffset < archiveHeaderSize || indexOffset > uint64(size) ||
+		indexOffset+8*uint64(blockCount) != uint64(size-archiveFooterSize) {
+		return nil, invalid("block offsets don't end at the footer")
+	}
+
+	s := &archivePageStore{
+		r:           r,
+		pageCount:   binary.LittleEndian.Uint32(header[12:16]),
+		cachedBlock: -1,
+	}
+	if (s.pageCount+archiveBlockPages-1)/archiveBlockPages != blockCount {
+		return nil, invalid(fmt.Sprintf("%d blocks for %d pages", blockCount, s.pageCount))
+	}
+
+	index := make([]byte, 8*blockCount)
+	_, err = r.ReadAt(index, int64(indexOffset))
+	if err != nil {
+		return nil, err
+	}
+	// Blocks are never empty, so every block must start after the
+	// previous one and before the offsets
+	previous := uint64(0)
+	for i := uint32(0); i < blockCount; i++ {
+		blockOffset := binary.LittleEndian.Uint64(index[8*i : 8*i+8])
+		if blockOffset < archiveHeaderSize || blockOffset >= indexOffset || (i > 0 && blockOffset <= previous) {
+			return nil, invalid(fmt.Sprintf("block %d has offset %d", i, blockOffset))
+		}
+		s.blockOffsets = append(s.blockOffsets, blockOffset)
+		previous = blockOffset
+	}
+	// The last block ends where the offsets start
+	s.blockOffsets = append(s.blockOffsets, indexOffset)
+
+	return s, nil
+}
+
+func (s *archivePageStore) block(block int) ([]byte, error) {
+	if block == s.cachedBlock {
+		return s.cached, nil
+	}
+
+	start, end := s.blockOffsets[block], s.blockOffsets[block+1]
+	section := io.NewSectionReader(s.r, int64(start), int64(end-start))
+
+	decompressor := flate.NewReader(section)
+	defer decompressor.Close()
+	data, err := io.ReadAll(decompressor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: block %d: %w", block, err)
+	}
+
+	s.cachedBlock = block
+	s.cached = data
+	return data, nil
+}
+
+func (s *archivePageStore) readAt(data []byte, offset int64) error {
+	for len(data) > 0 {
+		pageIndex := uint32(offset / int64(defaultPageSize))
+		if pageIndex >= s.pageCount {
+			return io.EOF
+		}
+
+		block := int(pageIndex / archiveBlockPages)
+		blockData, err := s.block(block)
+		if err != nil {
+			return err
+		}
+
+		blockOffset := offset - int64(block)*int64(archiveBlockPages*defaultPageSize)
+		if blockOffset >= int64(len(blockData)) {
+			return fmt.Errorf("invalid archive: block %d is too short", block)
+		}
+		n := copy(data, blockData[blockOffset:])
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+func (s *archivePageStore) writeAt(data []byte, offset int64) error {
+	return ErrReadOnly
+}
+
+func (s *archivePageStore) size() (int64, error) {
+	return int64(s.pageCount) * int64(defaultPageSize), nil
+}
+
+func (s *archivePageStore) sync(mode SyncMode) error {
+	return nil
+}
+
+func (s *archivePageStore) close() error {
+	if closer, ok := s.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package tinykv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+Backup layout:
+| OFFSET | SIZE | DATA
+|      0 |    4 | magic ("TKVB")
+|      4 |    4 | format version
+|      8 |    4 | page size
+|     12 |    4 | page count
+|     16 |    4 | extent count
+|     20 | 4*ec | CRC32 of each extent
+|        |      | pages
+
+An extent is a run of backupExtentPages consecutive pages, the last one
+may be shorter.
+*/
+
+const (
+	backupFormatVersion uint32 = 1
+	backupExtentPages   uint32 = 16
+	backupHeaderSize           = 20
+)
+
+var backupMagic = []byte("TKVB")
+
+// BackupManifest describes the contents of a backup.
+type BackupManifest struct {
+	FormatVersion   uint32
+	PageSize        uint32
+	PageCount       uint32
+	ExtentChecksums []uint32
+}
+
+// Backup writes a consistent copy of the database to w. The copy starts
+// with a manifest holding the page count and a checksum for every extent
+// of pages, so it can be validated with VerifyBackup without restoring
+// it.
+func (db *DB) Backup(w io.Writer) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bp := db.bufferPool
+
+	err := bp.flush()
+	if err != nil {
+		return err
+	}
+
+	pageCount, err := bp.getPageCount()
+	if err != nil {
+		return err
+	}
+
+	manifest := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		PageSize:      defaultPageSize,
+		PageCount:     pageCount,
+	}
+
+	// The checksums go before the pages, so read the file twice instead
+	// of buffering the whole database in memory
+	extent := alignedBuffer(int(backupExtentPages * defaultPageSize))
+	for pageIndex := uint32(0); pageIndex < pageCount; pageIndex += backupExtentPages {
+		data, err := readExtent(bp, extent, pageIndex, pageCount)
+		if err != nil {
+			return err
+		}
+		manifest.ExtentChecksums = append(manifest.ExtentChecksums, crc32.ChecksumIEEE(data))
+	}
+
+	err = writeBackupManifest(w, &manifest)
+	if err != nil {
+		return err
+	}
+
+	for pageIndex := uint32(0); pageIndex < pageCount; pageIndex += backupExtentPages {
+		data, err := readExtent(bp, extent, pageIndex, pageCount)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyBackup reads a backup written by DB.Backup and checks its
+// manifest against the page data. It returns the manifest if the backup
+// is intact.
+func VerifyBackup(r io.Reader) (*BackupManifest, error) {
+	manifest, err := readBackupManifest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	extent := make([]byte, backupExtentPages*manifest.PageSize)
+	for i, checksum := range manifest.ExtentChecksums {
+		extentPages := manifest.PageCount - uint32(i)*backupExtentPages
+		if extentPages > backupExtentPages {
+			extentPages = backupExtentPages
+		}
+
+		data := extent[:extentPages*manifest.PageSize]
+		_, err := io.ReadFull(r, data)
+		if err != nil {
+			return nil, fmt.Errorf("backup is truncated in extent %d: %w", i, err)
+		}
+
+		if crc32.ChecksumIEEE(data) != checksum {
+			return nil, fmt.Errorf("checksum mismatch in extent %d (pages %d to %d)",
+				i, uint32(i)*backupExtentPages, uint32(i)*backupExtentPages+extentPages-1)
+		}
+	}
+
+	n, _ := r.Read(extent[:1])
+	if n != 0 {
+		return nil, fmt.Errorf("unexpected data after the last extent")
+	}
+
+	return manifest, nil
+}
+
+// readExtent reads the pages from firstPage on into buf, as many as fit
+// in it, stopping at the end of the file.
+func readExtent(bp *bufferPool, buf []byte, firstPage uint32, pageCount uint32) ([]byte, error) {
+	extentPages := pageCount - firstPage
+	if maxPages := uint32(len(buf)) / defaultPageSize; extentPages > maxPages {
+		extentPages = maxPages
+	}
+
+	data := buf[:extentPages*defaultPageSize]
+	err := bp.store.readAt(data, int64(firstPage*defaultPageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func writeBackupManifest(w io.Writer, manifest *BackupManifest) error {
+	data := make([]byte, backupHeaderSize+4*len(manifest.ExtentChecksums))
+	copy(data[0:4], backupMagic)
+	binary.LittleEndian.PutUint32(data[4:8], manifest.FormatVersion)
+	binary.LittleEndian.PutUint32(data[8:12], manifest.PageSize)
+	binary.LittleEndian.PutUint32(data[12:16], manifest.PageCount)
+	binary.LittleEndian.PutUint32(data[16:20], uint32(len(manifest.ExtentChecksums)))
+	for i, checksum := range manifest.ExtentChecksums {
+		offset := backupHeaderSize + 4*i
+		binary.LittleEndian.PutUint32(data[offset:offset+4], checksum)
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+func readBackupManifest(r io.Reader) (*BackupManifest, error) {
+	header := make([]byte, backupHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("backup manifest is truncated: %w", err)
+	}
+
+	if !bytes.Equal(header[0:4], backupMagic) {
+		return nil, fmt.Errorf("not a tinykv backup")
+	}
+
+	manifest := &BackupManifest{
+		FormatVersion: binary.LittleEndian.Uint32(header[4:8]),
+		PageSize:      binary.LittleEndian.Uint32(header[8:12]),
+		PageCount:     binary.LittleEndian.Uint32(header[12:16]),
+	}
+	extentCount := binary.LittleEndian.Uint32(header[16:20])
+
+	if manifest.FormatVersion != backupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version: %d", manifest.FormatVersion)
+	}
+	if manifest.PageSize != defaultPageSize {
+		return nil, fmt.Errorf("unsupported backup page size: %d", manifest.PageSize)
+	}
+	if extentCount != (manifest.PageCount+backupExtentPages-1)/backupExtentPages {
+		return nil, fmt.Errorf("backup manifest has %d extents for %d pages", extentCount, manifest.PageCount)
+	}
+
+	checksums := make([]byte, 4*extentCount)
+	_, err = io.ReadFull(r, checksums)
+	if err != nil {
+		return nil, fmt.Errorf("backup manifest is truncated: %w", err)
+	}
+
+	manifest.ExtentChecksums = make([]uint32, extentCount)
+	for i := range manifest.ExtentChecksums {
+		manifest.ExtentChecksums[i] = binary.LittleEndian.Uint32(checksums[4*i : 4*i+4])
+	}
+
+	return manifest, nil
+}
+
+// Export writes a consistent copy of the database's contents to a new
+// database file at path, which must not exist. Unlike a backup, only the
+// pages of the tree are copied and they are packed densely, so the copy
+// is a standalone database that can be opened with the same KeyCodec.
+func (db *DB) Export(path string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	target, err := OpenDBWithOptions(path, &Options{
+		ErrorIfExists: true,
+		KeyCodec:      db.keyCodec,
+		SyncMode:      db.bufferPool.syncMode,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.exportTo(target)
+	target.Close()
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (db *DB) exportTo(target *DB) error {
+	root, err := target.bufferPool.getPage(target.rootIndex)
+	if err != nil {
+		return err
+	}
+
+	// Cells are copied with their stored keys, the key codec of both
+	// databases is the same
+	var addErr error
+	_, err = db.walkCells(db.rootIndex, func(pageIndex uint32, cell leafCell) (bool, error) {
+		addErr = root.(treePage).addCell(cell.key, cell.value)
+		return addErr == nil, addErr
+	})
+	if err != nil {
+		return err
+	}
+
+	return target.bufferPool.flush()
+}
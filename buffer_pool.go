@@ -3,27 +3,49 @@ package tinykv
 import (
 	"errors"
 	"fmt"
-	"os"
+	"time"
 )
 
 type bufferPool struct {
-	file  *os.File
-	pages []page
+	store    pageStore
+	pages    []page
+	maxSize  int64
+	tracer   *pageTracer
+	syncMode SyncMode
+	readOnly bool
+
+	// loaded holds the indexes of the cached pages, oldest first
+	loaded      []uint32
+	memoryLimit int64
+
+	bytesWritten uint64
+
+	// evictionTime and syncTime are the total time spent evicting pages
+	// and syncing the file, for write stall reporting
+	evictionTime time.Duration
+	syncTime     time.Duration
 }
 
-func newBufferPool(path string) (*bufferPool, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return nil, err
+func newBufferPool(store pageStore, opts *Options) (*bufferPool, error) {
+	bp := &bufferPool{
+		store:    store,
+		maxSize:  opts.MaxSize,
+		syncMode: opts.SyncMode,
+		readOnly: opts.ReadOnly,
+
+		memoryLimit: opts.MemoryLimit,
 	}
 
-	bp := &bufferPool{
-		file: file,
+	if opts.Trace != nil {
+		bp.tracer = newPageTracer(opts.Trace)
+	}
+
+	if bp.memoryLimit == 0 {
+		bp.memoryLimit = defaultMemoryLimit()
 	}
 
 	pageCount, err := bp.getPageCount()
 	if err != nil {
-		bp.close()
 		return nil, err
 	}
 
@@ -33,34 +55,67 @@ func newBufferPool(path string) (*bufferPool, error) {
 }
 
 func (bp *bufferPool) close() {
+	bp.flush()
+	bp.store.close()
+	bp.pages = []page{} // Free memory
+	bp.loaded = nil
+}
+
+func (bp *bufferPool) flush() error {
+	if bp.readOnly {
+		// Pages are never modified, there is nothing to write back
+		return nil
+	}
+
 	for pageIndex, page := range bp.pages {
 		if page != nil {
-			bp.flushPage(uint32(pageIndex))
+			err := bp.flushPage(uint32(pageIndex))
+			if err != nil {
+				return err
+			}
 		}
 	}
-	bp.file.Close()
-	bp.pages = []page{} // Free memory
+	return bp.store.sync(bp.syncMode)
 }
 
 func (bp *bufferPool) getPageCount() (uint32, error) {
-	fileInfo, err := bp.file.Stat()
+	size, err := bp.store.size()
 	if err != nil {
 		return 0, err
 	}
-	pageCount := uint32(fileInfo.Size()) / defaultPageSize
+	pageCount := uint32(size) / defaultPageSize
 	return pageCount, nil
 }
 
 func (bp *bufferPool) addPage(page page) error {
+	if bp.readOnly {
+		return ErrReadOnly
+	}
+
 	pageIndex, err := bp.getPageCount()
 	if err != nil {
 		return err
 	}
 
+	if bp.maxSize > 0 && int64(pageIndex+1)*int64(defaultPageSize) > bp.maxSize {
+		return ErrDatabaseFull
+	}
+
 	bp.pages = append(bp.pages, page)
-	bp.flushPage(pageIndex)
+	bp.loaded = append(bp.loaded, pageIndex)
+	err = bp.flushPage(pageIndex)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	start := time.Now()
+	err = bp.store.sync(bp.syncMode)
+	bp.syncTime += time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	return bp.enforceMemoryLimit(pageIndex)
 }
 
 func (bp *bufferPool) getPage(pageIndex uint32) (page, error) {
@@ -69,12 +124,15 @@ func (bp *bufferPool) getPage(pageIndex uint32) (page, error) {
 		return nil, fmt.Errorf("Invalid page index: %d\n", pageIndex)
 	}
 
+	start := time.Now()
+
 	if bp.pages[pageIndex] == nil {
-		// Page is not cached in memory, so let's allocate space for it
-		pageData := make([]uint8, defaultPageSize)
+		// Page is not cached in memory, so let's allocate space for it.
+		// It is aligned so direct I/O can read into it without copying.
+		pageData := alignedBuffer(int(defaultPageSize))
 
 		pageOffset := pageIndex * defaultPageSize
-		_, err := bp.file.ReadAt(pageData, int64(pageOffset))
+		err := bp.store.readAt(pageData, int64(pageOffset))
 		if err != nil {
 			return nil, err
 		}
@@ -82,29 +140,122 @@ func (bp *bufferPool) getPage(pageIndex uint32) (page, error) {
 		var page page
 		switch pageKind(pageData[0]) {
 		case pageKindHeader:
-			panic("TODO: import header page")
-		case pageKindUnallocated:
-			panic("TODO: import unallocated page")
+			err = checkHeaderPageData(pageIndex, pageData)
+			if err != nil {
+				return nil, err
+			}
+			page = newHeaderPage(pageData)
 		case pageKindLeaf:
+			err = checkLeafPageData(pageIndex, pageData)
+			if err != nil {
+				return nil, err
+			}
 			page = newLeafPage(pageData)
-		case pageKindInternal:
-			panic("TODO: import internal page")
 		default:
-			panic("invalid page kind")
+			// Nothing writes unallocated or internal pages yet, so
+			// finding one means the kind byte is corrupted
+			return nil, &CorruptionError{
+				PageIndex:   pageIndex,
+				Offset:      0,
+				ParentIndex: -1,
+				Expected:    "a header or leaf page",
+				Found:       fmt.Sprintf("page kind %d", pageData[0]),
+			}
 		}
 
 		bp.pages[pageIndex] = page
+		bp.loaded = append(bp.loaded, pageIndex)
+		bp.tracer.record(TraceOpRead, page, pageIndex, start)
+
+		err = bp.enforceMemoryLimit(pageIndex)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		bp.tracer.record(TraceOpHit, bp.pages[pageIndex], pageIndex, start)
 	}
 
 	return bp.pages[pageIndex], nil
 }
 
+// enforceMemoryLimit evicts the oldest cached pages, except keep, until
+// the cached pages fit in the memory limit.
+func (bp *bufferPool) enforceMemoryLimit(keep uint32) error {
+	if bp.memoryLimit <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { bp.evictionTime += time.Since(start) }()
+
+	for i := 0; i < len(bp.loaded) && bp.cachedBytes() > bp.memoryLimit; {
+		pageIndex := bp.loaded[i]
+		if pageIndex == keep {
+			i++
+			continue
+		}
+
+		err := bp.evictPage(pageIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evictPage writes a cached page back and drops it from memory.
+func (bp *bufferPool) evictPage(pageIndex uint32) error {
+	if !bp.readOnly {
+		err := bp.flushPage(pageIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	bp.pages[pageIndex] = nil
+	for i, loadedIndex := range bp.loaded {
+		if loadedIndex == pageIndex {
+			bp.loaded = append(bp.loaded[:i], bp.loaded[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// evictAll writes back and evicts every cached page.
+func (bp *bufferPool) evictAll() error {
+	for len(bp.loaded) > 0 {
+		err := bp.evictPage(bp.loaded[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if bp.readOnly {
+		return nil
+	}
+	return bp.store.sync(bp.syncMode)
+}
+
+func (bp *bufferPool) cachedBytes() int64 {
+	return int64(len(bp.loaded)) * int64(defaultPageSize)
+}
+
 func (bp *bufferPool) flushPage(pageIndex uint32) error {
 	page := bp.pages[pageIndex]
 	if page == nil {
 		return errors.New("tried to flush unloaded page")
 	}
 
-	_, err := bp.file.WriteAt(page.getData(), int64(pageIndex*defaultPageSize))
-	return err
+	start := time.Now()
+	err := bp.store.writeAt(page.getData(), int64(pageIndex*defaultPageSize))
+	bp.tracer.record(TraceOpWrite, page, pageIndex, start)
+	if err != nil {
+		return err
+	}
+
+	bp.bytesWritten += uint64(len(page.getData()))
+	return nil
 }
@@ -0,0 +1,354 @@
+// Command tinykv-stress runs a randomized workload against a tinykv
+// database and checks it against an in-memory model, closing and
+// reopening the database between cycles. Every run is derived from a
+// seed, which is printed on failure so the run can be replayed with
+// -seed. Each worker's operations are fixed by the seed, but with more
+// than one worker the interleaving isn't, so use -workers=1 to replay a
+// run exactly.
+//
+// Workers record the operations they meant to make in the model
+// themselves, so writes the database drops are caught. Every key belongs
+// to a single worker, which keeps the operations on a key in order and
+// the model exact with any number of workers.
+//
+// Some cycles end in a simulated crash instead of a Close: the cached
+// pages are written back, more writes are made, and the file is copied
+// as it is on disk while the handle is abandoned. The copy must then be
+// consistent and hold, for every key, either its value at the write back
+// or one it was given afterwards.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/felipeagc/tinykv"
+)
+
+var (
+	seed       = flag.Int64("seed", 0, "seed for the workload, 0 picks one from the clock")
+	workers    = flag.Int("workers", 4, "number of concurrent writers")
+	cycles     = flag.Int("cycles", 10, "number of close/reopen cycles")
+	opsPerTurn = flag.Int("ops", 1000, "operations per worker in each cycle")
+	numKeys    = flag.Int("keys", 64, "size of the keyspace")
+	maxValue   = flag.Int("max-value", 32, "maximum value length in bytes")
+	crashRate  = flag.Float64("crash-rate", 0.3, "fraction of cycles that end in a simulated crash")
+)
+
+type model struct {
+	mu sync.Mutex
+	// values holds the expected value of every key, nil for missing keys
+	values map[string][]byte
+	// unsynced holds, for every key written since the last write back,
+	// the values it may have on disk after a crash
+	unsynced map[string][][]byte
+}
+
+func newModel() *model {
+	return &model{
+		values:   make(map[string][]byte),
+		unsynced: make(map[string][][]byte),
+	}
+}
+
+func (m *model) get(key []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[string(key)]
+}
+
+// record sets the expected value of key, nil deletes it.
+func (m *model) record(key, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if value != nil {
+		value = append([]byte{}, value...)
+	}
+	if _, ok := m.unsynced[string(key)]; !ok {
+		m.unsynced[string(key)] = [][]byte{m.values[string(key)]}
+	}
+	m.unsynced[string(key)] = append(m.unsynced[string(key)], value)
+
+	if value == nil {
+		delete(m.values, string(key))
+		return
+	}
+	m.values[string(key)] = value
+}
+
+// synced marks every value as written to disk.
+func (m *model) synced() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unsynced = make(map[string][][]byte)
+}
+
+func main() {
+	flag.Parse()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if *workers < 1 || *numKeys < *workers {
+		fmt.Fprintln(os.Stderr, "-keys must be at least -workers, which must be at least 1")
+		os.Exit(2)
+	}
+
+	dir, err := os.MkdirTemp("", "tinykv-stress")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	err = run(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL seed=%d: %v\n", *seed, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	fmt.Printf("ok seed=%d\n", *seed)
+}
+
+func run(dir string) error {
+	m := newModel()
+	rng := rand.New(rand.NewSource(*seed))
+	path := filepath.Join(dir, "stress.db")
+	crashed := false
+
+	for cycle := 0; cycle < *cycles; cycle++ {
+		db, err := tinykv.OpenDB(path)
+		if err != nil {
+			return fmt.Errorf("cycle %d: open: %w", cycle, err)
+		}
+
+		if crashed {
+			err = checkCrash(db, m)
+		} else {
+			err = check(db, m)
+		}
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("cycle %d: after reopen: %w", cycle, err)
+		}
+
+		err = runWorkers(db, m, cycle, 0)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("cycle %d: %w", cycle, err)
+		}
+
+		crashed = rng.Float64() < *crashRate
+		if !crashed {
+			err = check(db, m)
+			db.Close()
+			if err != nil {
+				return fmt.Errorf("cycle %d: %w", cycle, err)
+			}
+			m.synced()
+			continue
+		}
+
+		err = db.DropCaches()
+		if err != nil {
+			return fmt.Errorf("cycle %d: drop caches: %w", cycle, err)
+		}
+		m.synced()
+
+		err = runWorkers(db, m, cycle, 1)
+		if err != nil {
+			return fmt.Errorf("cycle %d: after drop caches: %w", cycle, err)
+		}
+
+		// The handle is abandoned without Close, like in a crashed
+		// process, and the next cycle opens what was on disk. It has to
+		// be a copy, as the abandoned handle keeps the path open.
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cycle %d: %w", cycle, err)
+		}
+		path = filepath.Join(dir, fmt.Sprintf("stress-crash%d.db", cycle))
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			return fmt.Errorf("cycle %d: %w", cycle, err)
+		}
+	}
+
+	return nil
+}
+
+func runWorkers(db *tinykv.DB, m *model, cycle int, turn int) error {
+	errs := make(chan error, *workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < *workers; worker++ {
+		wg.Add(1)
+		rng := rand.New(rand.NewSource(*seed + int64((2*cycle+turn)**workers+worker)))
+		go func(worker int) {
+			defer wg.Done()
+			errs <- work(db, m, rng, worker)
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// work runs operations on the keys owned by worker, the ones whose
+// index is worker modulo the number of workers.
+func work(db *tinykv.DB, m *model, rng *rand.Rand, worker int) error {
+	ownedKeys := (*numKeys - worker + *workers - 1) / *workers
+
+	for i := 0; i < *opsPerTurn; i++ {
+		key := []byte(fmt.Sprintf("key%04d", rng.Intn(ownedKeys)**workers+worker))
+
+		switch rng.Intn(4) {
+		case 0:
+			value := make([]byte, rng.Intn(*maxValue+1))
+			rng.Read(value)
+			err := db.Set(key, value)
+			if err != nil {
+				return fmt.Errorf("set '%s': %w", key, err)
+			}
+			m.record(key, value)
+		case 1:
+			// The expected value is derived from the model, so an update
+			// applied on top of a dropped write doesn't match it
+			b := byte(rng.Intn(256))
+			update := func(old []byte) []byte {
+				if len(old) >= *maxValue {
+					return []byte{}
+				}
+				return append(append([]byte{}, old...), b)
+			}
+			err := db.UpdateValue(key, func(old []byte) ([]byte, error) {
+				return update(old), nil
+			})
+			if err != nil {
+				return fmt.Errorf("update '%s': %w", key, err)
+			}
+			m.record(key, update(m.get(key)))
+		case 2:
+			value, err := db.Get(key)
+			if err != nil {
+				return fmt.Errorf("get '%s': %w", key, err)
+			}
+			err = checkValue(key, value, m.get(key))
+			if err != nil {
+				return err
+			}
+		case 3:
+			// Keys have a fixed width, so the prefix matches only key
+			_, err := db.DeletePrefix(key)
+			if err != nil {
+				return fmt.Errorf("delete '%s': %w", key, err)
+			}
+			m.record(key, nil)
+		}
+	}
+	return nil
+}
+
+func checkValue(key, value, expected []byte) error {
+	switch {
+	case expected == nil && value != nil:
+		return fmt.Errorf("deleted key '%s' has value %x", key, value)
+	case expected != nil && value == nil:
+		return fmt.Errorf("key '%s' is missing", key)
+	case !bytes.Equal(value, expected):
+		return fmt.Errorf("key '%s' has value %x, expected %x", key, value, expected)
+	}
+	return nil
+}
+
+func check(db *tinykv.DB, m *model) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, expected := range m.values {
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get '%s': %w", key, err)
+		}
+		err = checkValue([]byte(key), value, expected)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkCells(db, len(m.values))
+}
+
+// checkCrash checks the database left by a crash, which must hold every
+// key either as it was written back or as one of its later values. The
+// model is then reset to what the database holds.
+func checkCrash(db *tinykv.DB, m *model) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := db.Check()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < *numKeys; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get '%s': %w", key, err)
+		}
+
+		candidates, ok := m.unsynced[key]
+		if !ok {
+			candidates = [][]byte{m.values[key]}
+		}
+		found := false
+		for _, candidate := range candidates {
+			if (candidate == nil) == (value == nil) && bytes.Equal(value, candidate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("key '%s' has value %x after the crash, expected one of %x", key, value, candidates)
+		}
+
+		if value == nil {
+			delete(m.values, key)
+		} else {
+			m.values[key] = value
+		}
+	}
+	m.unsynced = make(map[string][][]byte)
+
+	return checkCells(db, len(m.values))
+}
+
+// checkCells checks that the tree holds exactly keys cells.
+func checkCells(db *tinykv.DB, keys int) error {
+	report, err := db.FragmentationReport()
+	if err != nil {
+		return err
+	}
+	cells := 0
+	for _, level := range report.Levels {
+		cells += level.Cells
+	}
+	if cells != keys {
+		return fmt.Errorf("tree has %d cells, model has %d keys", cells, keys)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/felipeagc/tinykv"
+)
+
+// record is a line of build's input.
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// buildConfig holds the flags of build.
+type buildConfig struct {
+	input    string
+	out      string
+	sorted   bool
+	compress bool
+	useHex   bool
+}
+
+func build(args []string) error {
+	var cfg buildConfig
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.StringVar(&cfg.input, "input", "", "JSON lines file to read the pairs from")
+	flags.BoolVar(&cfg.sorted, "sorted", false, "check that the input is sorted by key without duplicates")
+	flags.BoolVar(&cfg.compress, "compress", false, "write a compressed read-only archive")
+	flags.BoolVar(&cfg.useHex, "hex", false, "read keys and values as hex")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || cfg.input == "" {
+		usage()
+	}
+	cfg.out = flags.Arg(0)
+
+	return runBuild(cfg, os.Stdout)
+}
+
+// runBuild creates the database described by cfg and reports what it
+// wrote to w.
+func runBuild(cfg buildConfig, w io.Writer) error {
+	// Archives are written from a finished database
+	path := cfg.out
+	if cfg.compress {
+		if _, err := os.Stat(cfg.out); err == nil {
+			return &os.PathError{Op: "create", Path: cfg.out, Err: os.ErrExist}
+		}
+		path = cfg.out + ".tmp"
+	}
+
+	db, err := tinykv.OpenDBWithOptions(path, &tinykv.Options{ErrorIfExists: true})
+	if err != nil {
+		return err
+	}
+	// Only files this run created are removed
+	if cfg.compress {
+		defer os.Remove(path)
+	}
+
+	count, err := load(db, cfg.input, cfg.sorted, cfg.useHex)
+	if err == nil && cfg.compress {
+		err = writeArchive(db, cfg.out)
+	}
+	db.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	fmt.Fprintf(w, "wrote %d pairs to %s\n", count, cfg.out)
+	return nil
+}
+
+func load(db *tinykv.DB, input string, sorted bool, useHex bool) (int, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+
+	count := 0
+	var lastKey []byte
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var r record
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: %w", input, line, err)
+		}
+		key, err := parseKey(r.Key, useHex)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: invalid key: %w", input, line, err)
+		}
+		value, err := parseKey(r.Value, useHex)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: invalid value: %w", input, line, err)
+		}
+
+		if sorted && count > 0 && bytes.Compare(lastKey, key) >= 0 {
+			return count, fmt.Errorf("%s:%d: key %s doesn't sort after %s",
+				input, line, formatKey(key, useHex), formatKey(lastKey, useHex))
+		}
+		lastKey = key
+
+		err = db.Set(key, value)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: %w", input, line, err)
+		}
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+func writeArchive(db *tinykv.DB, out string) error {
+	file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = db.WriteArchive(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/felipeagc/tinykv"
+)
+
+func writeInput(t *testing.T, dir string, lines string) string {
+	input := filepath.Join(dir, "input.jsonl")
+	err := os.WriteFile(input, []byte(lines), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+func checkBuilt(t *testing.T, db *tinykv.DB, expected map[string]string) {
+	t.Helper()
+	pairs, _, err := db.GetRange(nil, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(expected) {
+		t.Fatalf("expected %d pairs, got %v", len(expected), pairs)
+	}
+	for _, kv := range pairs {
+		value, ok := expected[string(kv.Key)]
+		if !ok || value != string(kv.Value) {
+			t.Errorf("unexpected pair %q = %q", kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, dir, `{"key": "a", "value": "1"}
+
+{"key": "b", "value": "2"}
+{"key": "a", "value": "3"}
+`)
+
+	out := filepath.Join(dir, "out.db")
+	err := runBuild(buildConfig{input: input, out: out}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := tinykv.OpenDBWithOptions(out, &tinykv.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBuilt(t, db, map[string]string{"a": "3", "b": "2"})
+	db.Close()
+
+	// The output must not exist yet
+	err = runBuild(buildConfig{input: input, out: out}, io.Discard)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected building over an existing file to fail, got %v", err)
+	}
+
+	// The duplicate key is rejected with -sorted
+	err = runBuild(buildConfig{input: input, out: filepath.Join(dir, "sorted.db"), sorted: true}, io.Discard)
+	if err == nil {
+		t.Errorf("expected unsorted input to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sorted.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the failed build to be removed, got %v", err)
+	}
+}
+
+func TestBuildHexCompressed(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, dir, `{"key": "00ff", "value": "0102"}
+{"key": "61", "value": ""}
+`)
+
+	out := filepath.Join(dir, "out.archive")
+	var report bytes.Buffer
+	err := runBuild(buildConfig{input: input, out: out, sorted: true, compress: true, useHex: true}, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.String() != "wrote 2 pairs to "+out+"\n" {
+		t.Errorf("unexpected report %q", report.String())
+	}
+	if _, err := os.Stat(out + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the temporary database to be removed, got %v", err)
+	}
+
+	db, err := tinykv.OpenArchive(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBuilt(t, db, map[string]string{"\x00\xff": "\x01\x02", "a": ""})
+	db.Close()
+
+	// A temporary file this run didn't create is left alone
+	tmp := filepath.Join(dir, "other.archive.tmp")
+	err = os.WriteFile(tmp, []byte("not ours"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runBuild(buildConfig{input: input, out: filepath.Join(dir, "other.archive"), compress: true, useHex: true}, io.Discard)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected an existing temporary file to fail the build, got %v", err)
+	}
+	if data, err := os.ReadFile(tmp); err != nil || string(data) != "not ours" {
+		t.Errorf("existing temporary file was modified or removed: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+// Command tinykv inspects and edits tinykv databases.
+//
+// Usage:
+//
+//	tinykv top [-hex] [-depth n] [-delim c] [-n limit] path
+//	tinykv stats path
+//	tinykv del [-hex] -prefix p path
+//	tinykv build [-hex] [-sorted] [-compress] -input data.jsonl out
+//	tinykv trace-report [-n limit] trace
+//
+// top lists the key prefixes taking up the most space. It opens the
+// database read-only, so it can be used while another process has it
+// open.
+//
+// stats prints how many keys and values of each size were ever written,
+// in power-of-two buckets, along with percentiles of the sizes. It also
+// opens the database read-only.
+//
+// del deletes every key starting with the prefix and prints how many
+// were deleted. An empty prefix deletes every key.
+//
+// build creates a new database from a file with one JSON object per
+// line, {"key": "...", "value": "..."}. With -sorted the input must be
+// sorted by key without duplicates, which is checked, otherwise later
+// lines replace earlier ones with the same key. With -compress the
+// output is an archive, see tinykv.OpenArchive.
+//
+// trace-report summarizes a trace written to tinykv.Options.Trace: the
+// read amplification and the most accessed pages. A truncated trace, as
+// left by a crashed process, is summarized up to the last whole record.
+//
+// Keys are printed as Go quoted strings, with non-printable bytes
+// escaped. With -hex, keys are printed and read as hex instead.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/felipeagc/tinykv"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "top":
+		err = top(os.Args[2:])
+	case "stats":
+		err = stats(os.Args[2:])
+	case "del":
+		err = del(os.Args[2:])
+	case "build":
+		err = build(os.Args[2:])
+	case "trace-report":
+		err = traceReport(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tinykv top [-hex] [-depth n] [-delim c] [-n limit] path")
+	fmt.Fprintln(os.Stderr, "       tinykv stats path")
+	fmt.Fprintln(os.Stderr, "       tinykv del [-hex] -prefix p path")
+	fmt.Fprintln(os.Stderr, "       tinykv build [-hex] [-sorted] [-compress] -input data.jsonl out")
+	fmt.Fprintln(os.Stderr, "       tinykv trace-report [-n limit] trace")
+	os.Exit(2)
+}
+
+func top(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	depth := flags.Int("depth", 1, "prefix length in bytes, or in segments with -delim")
+	delim := flags.String("delim", "", "group keys by segments separated by this byte")
+	limit := flags.Int("n", 20, "number of prefixes to list, 0 lists all of them")
+	useHex := flags.Bool("hex", false, "print keys and read -delim as hex")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		usage()
+	}
+	if *depth < 1 {
+		return fmt.Errorf("invalid -depth: must be at least 1")
+	}
+
+	delimiter, err := parseKey(*delim, *useHex)
+	if err != nil {
+		return fmt.Errorf("invalid -delim: %w", err)
+	}
+	if len(delimiter) > 1 {
+		return fmt.Errorf("invalid -delim: must be a single byte")
+	}
+
+	db, err := tinykv.OpenDBWithOptions(flags.Arg(0), &tinykv.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var stats []tinykv.PrefixStats
+	if len(delimiter) == 1 {
+		stats, err = db.DelimitedPrefixStats(delimiter[0], *depth)
+	} else {
+		stats, err = db.PrefixStats(*depth)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *limit > 0 && len(stats) > *limit {
+		stats = stats[:*limit]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "keys\tkey bytes\tvalue bytes\t\tprefix")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%d\t%d\t%d\t\t%s\n", s.Keys, s.KeyBytes, s.ValueBytes, formatKey(s.Prefix, *useHex))
+	}
+	return w.Flush()
+}
+
+func stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	db, err := tinykv.OpenDBWithOptions(flags.Arg(0), &tinykv.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return printSizeHistograms(os.Stdout, db.Stats())
+}
+
+// printSizeHistograms lists the buckets of the key and value size
+// histograms that counted any write, followed by their percentiles,
+// which are upper bounds.
+func printSizeHistograms(out io.Writer, s tinykv.Stats) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "size\tkeys\tvalues\t")
+	for bucket := range s.KeySizes {
+		if s.KeySizes[bucket] == 0 && s.ValueSizes[bucket] == 0 {
+			continue
+		}
+
+		min, max := s.KeySizes.BucketRange(bucket)
+		size := fmt.Sprintf("%d-%d", min, max)
+		switch {
+		case max == math.MaxInt:
+			size = fmt.Sprintf("%d+", min)
+		case min == max:
+			size = fmt.Sprint(min)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", size, s.KeySizes[bucket], s.ValueSizes[bucket])
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t\n", s.KeySizes.Count(), s.ValueSizes.Count())
+	for _, p := range []float64{50, 90, 99} {
+		fmt.Fprintf(w, "p%g\t%s\t%s\t\n", p, formatPercentile(s.KeySizes, p), formatPercentile(s.ValueSizes, p))
+	}
+	return w.Flush()
+}
+
+// formatPercentile renders a percentile of h, which falls in the last,
+// unbounded bucket when it is math.MaxInt.
+func formatPercentile(h tinykv.SizeHistogram, p float64) string {
+	size := h.Percentile(p)
+	if size == math.MaxInt {
+		min, _ := h.BucketRange(len(h) - 1)
+		return fmt.Sprintf("%d+", min)
+	}
+	return fmt.Sprint(size)
+}
+
+func del(args []string) error {
+	flags := flag.NewFlagSet("del", flag.ExitOnError)
+	prefixArg := flags.String("prefix", "", "delete the keys starting with this prefix")
+	useHex := flags.Bool("hex", false, "read -prefix as hex")
+	flags.Parse(args)
+
+	// The prefix is required, even if it is empty, so deleting every key
+	// is never an accident
+	prefixSet := false
+	flags.Visit(func(f *flag.Flag) {
+		prefixSet = prefixSet || f.Name == "prefix"
+	})
+	if flags.NArg() != 1 || !prefixSet {
+		usage()
+	}
+
+	prefix, err := parseKey(*prefixArg, *useHex)
+	if err != nil {
+		return fmt.Errorf("invalid -prefix: %w", err)
+	}
+
+	db, err := tinykv.OpenDBWithOptions(flags.Arg(0), &tinykv.Options{MustExist: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deleted, err := db.DeletePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d keys\n", deleted)
+	return nil
+}
+
+func traceReport(args []string) error {
+	flags := flag.NewFlagSet("trace-report", flag.ExitOnError)
+	limit := flags.Int("n", 20, "number of pages to list, 0 lists all of them")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, err := tinykv.ReadTrace(bufio.NewReader(file))
+	if err != nil {
+		if len(records) == 0 {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	return printTraceReport(os.Stdout, tinykv.SummarizeTrace(records), *limit)
+}
+
+// printTraceReport prints the totals of report followed by its hottest
+// pages, at most limit of them if limit > 0.
+func printTraceReport(out io.Writer, report *tinykv.TraceReport, limit int) error {
+	fmt.Fprintf(out, "%d hits, %d reads, %d writes\n", report.Hits, report.Reads, report.Writes)
+	fmt.Fprintf(out, "read amplification: %.3f\n\n", report.ReadAmplification())
+
+	pages := report.Pages
+	if limit > 0 && len(pages) > limit {
+		pages = pages[:limit]
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "page\taccesses\thits\treads\twrites\tI/O time\t")
+	for _, p := range pages {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%s\t\n", p.PageIndex, p.Accesses(), p.Hits, p.Reads, p.Writes, p.IOTime)
+	}
+	return w.Flush()
+}
+
+// parseKey reads a key given on the command line.
+func parseKey(s string, useHex bool) ([]byte, error) {
+	if useHex {
+		return hex.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+// formatKey renders a key for the terminal, so binary keys can't garble
+// the output.
+func formatKey(key []byte, useHex bool) string {
+	if useHex {
+		if len(key) == 0 {
+			return "(empty)"
+		}
+		return hex.EncodeToString(key)
+	}
+	return fmt.Sprintf("%q", key)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felipeagc/tinykv"
+)
+
+func TestPrintSizeHistograms(t *testing.T) {
+	var s tinykv.Stats
+	s.KeySizes[0] = 1
+	s.KeySizes[3] = 2
+	s.ValueSizes[3] = 2
+	s.ValueSizes[len(s.ValueSizes)-1] = 1
+
+	var out bytes.Buffer
+	err := printSizeHistograms(&out, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	expected := []string{
+		"size keys values",
+		"0 1 0",
+		"4-7 2 2",
+		"4194304+ 0 1",
+		"total 3 3",
+		"p50 7 7",
+		"p90 7 4194304+",
+		"p99 7 4194304+",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestPrintTraceReport(t *testing.T) {
+	report := &tinykv.TraceReport{
+		Hits:   6,
+		Reads:  2,
+		Writes: 1,
+		Pages: []tinykv.PageTraceStats{
+			{PageIndex: 1, Hits: 5, Reads: 1, Writes: 1, IOTime: 3 * time.Millisecond},
+			{PageIndex: 0, Hits: 1, Reads: 1, IOTime: time.Millisecond},
+		},
+	}
+
+	var out bytes.Buffer
+	err := printTraceReport(&out, report, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	expected := []string{
+		"6 hits, 2 reads, 1 writes",
+		"read amplification: 0.250",
+		"",
+		"page accesses hits reads writes I/O time",
+		"1 6 5 1 1 3ms",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
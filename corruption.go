@@ -0,0 +1,315 @@
+package tinykv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// CorruptionError describes a page whose contents don't match the
+// on-disk format.
+type CorruptionError struct {
+	PageIndex uint32
+	// Offset is the byte offset within the page where the problem was
+	// found.
+	Offset uint32
+	// ParentIndex is the parent page recorded in the corrupted page, or
+	// -1 if it is the root or the parent couldn't be read.
+	ParentIndex int32
+	Expected    string
+	Found       string
+}
+
+func (e *CorruptionError) Error() string {
+	msg := fmt.Sprintf("page %d is corrupted at offset %d: expected %s, found %s",
+		e.PageIndex, e.Offset, e.Expected, e.Found)
+	if e.ParentIndex >= 0 {
+		msg += fmt.Sprintf(" (parent page %d)", e.ParentIndex)
+	}
+	return msg
+}
+
+// checkLeafPageData verifies that the cells of a leaf page loaded from
+// disk fit inside the page and are sorted by key.
+func checkLeafPageData(pageIndex uint32, data []byte) error {
+	parentIndex := int32(binary.LittleEndian.Uint32(data[leafPageParentIndexOffset : leafPageParentIndexOffset+4]))
+	if data[leafPageIsRootOffset] == 1 {
+		parentIndex = -1
+	}
+
+	corrupted := func(offset uint32, expected string, found string) error {
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			Offset:      offset,
+			ParentIndex: parentIndex,
+			Expected:    expected,
+			Found:       found,
+		}
+	}
+
+	pageSize := uint32(len(data))
+	numCells := binary.LittleEndian.Uint32(data[leafPageNumCellsOffset : leafPageNumCellsOffset+4])
+	maxCells := (pageSize - leafPageFirstCellOffset) / getLeafNodeCellSize(0, 0)
+	if numCells > maxCells {
+		return corrupted(leafPageNumCellsOffset,
+			fmt.Sprintf("at most %d cells", maxCells),
+			fmt.Sprintf("%d cells", numCells))
+	}
+
+	var lastKey []byte
+	offset := uint32(leafPageFirstCellOffset)
+	for i := uint32(0); i < numCells; i++ {
+		cellOffset := offset
+
+		for _, field := range []string{"key", "value"} {
+			if offset+4 > pageSize {
+				return corrupted(offset, fmt.Sprintf("%s length of cell %d", field, i), "end of page")
+			}
+			length := binary.LittleEndian.Uint32(data[offset : offset+4])
+			if uint64(offset)+4+uint64(length) > uint64(pageSize) {
+				return corrupted(offset,
+					fmt.Sprintf("%s of cell %d to end before byte %d", field, i, pageSize),
+					fmt.Sprintf("%s length %d", field, length))
+			}
+			offset += 4 + length
+		}
+
+		keyLen := binary.LittleEndian.Uint32(data[cellOffset : cellOffset+4])
+		key := data[cellOffset+4 : cellOffset+4+keyLen]
+		if i > 0 && bytes.Compare(lastKey, key) >= 0 {
+			return corrupted(cellOffset,
+				fmt.Sprintf("cell %d key to sort after %q", i, lastKey),
+				fmt.Sprintf("%q", key))
+		}
+		lastKey = key
+	}
+
+	return nil
+}
+
+// checkInternalPageData verifies that the cells of an internal page fit
+// inside the page, so its children can be walked.
+func checkInternalPageData(pageIndex uint32, data []byte) error {
+	parentIndex := int32(binary.LittleEndian.Uint32(data[internalPageParentIndexOffset : internalPageParentIndexOffset+4]))
+	if data[internalPageIsRootOffset] == 1 {
+		parentIndex = -1
+	}
+
+	pageSize := uint32(len(data))
+	numCells := binary.LittleEndian.Uint32(data[internalPageNumCellsOffset : internalPageNumCellsOffset+4])
+	offset := uint32(internalPageFirstCellOffset)
+	for i := uint32(0); i < numCells; i++ {
+		if offset+8 > pageSize {
+			return &CorruptionError{
+				PageIndex:   pageIndex,
+				Offset:      offset,
+				ParentIndex: parentIndex,
+				Expected:    fmt.Sprintf("cell %d of %d", i, numCells),
+				Found:       "end of page",
+			}
+		}
+		keyLen := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		if uint64(offset)+8+uint64(keyLen) > uint64(pageSize) {
+			return &CorruptionError{
+				PageIndex:   pageIndex,
+				Offset:      offset + 4,
+				ParentIndex: parentIndex,
+				Expected:    fmt.Sprintf("key of cell %d to end before byte %d", i, pageSize),
+				Found:       fmt.Sprintf("key length %d", keyLen),
+			}
+		}
+		offset += 8 + keyLen
+	}
+
+	return nil
+}
+
+const (
+	// paranoidCheckDepth is how many levels of the tree a paranoid open
+	// checks when it doesn't check every page
+	paranoidCheckDepth = 2
+
+	defaultParanoidCheckInterval = 16
+)
+
+// Check writes back the cached pages and verifies every page reachable
+// from the root as stored on disk, including that the parent index
+// stored in each page matches the page it was reached from. It returns a
+// *CorruptionError for the first problem found.
+func (db *DB) Check() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.check(0)
+}
+
+// paranoidCheck runs the check done by paranoid opens.
+func (db *DB) paranoidCheck(interval int) error {
+	if interval <= 0 {
+		interval = defaultParanoidCheckInterval
+	}
+
+	maxDepth := paranoidCheckDepth
+	if db.rootIndex != 0 && !db.readOnly {
+		header, err := db.getHeaderPage()
+		if err != nil {
+			return err
+		}
+		opens := header.getParanoidOpens()
+		header.setParanoidOpens(opens + 1)
+		if opens%uint32(interval) == 0 {
+			maxDepth = 0
+		}
+	}
+
+	return db.check(maxDepth)
+}
+
+// check verifies the header page and the first maxDepth levels of the
+// tree as stored on disk, or every level if maxDepth is 0.
+func (db *DB) check(maxDepth int) error {
+	err := db.bufferPool.flush()
+	if err != nil {
+		return err
+	}
+
+	data := alignedBuffer(int(defaultPageSize))
+	if db.rootIndex != 0 {
+		err = db.checkPageOnDisk(0, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.checkSubtree(db.rootIndex, -1, 1, maxDepth, data, make(map[uint32]bool))
+}
+
+// checkSubtree verifies the page at pageIndex, reached from parentIndex
+// or -1 for the root, and its children down to maxDepth.
+func (db *DB) checkSubtree(pageIndex uint32, parentIndex int32, depth int, maxDepth int, data []byte, visited map[uint32]bool) error {
+	if visited[pageIndex] {
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			ParentIndex: -1,
+			Expected:    "each page to be reachable once",
+			Found:       "a cycle in the tree",
+		}
+	}
+	visited[pageIndex] = true
+
+	err := db.checkPageOnDisk(pageIndex, data)
+	if err != nil {
+		return err
+	}
+
+	err = checkParentIndex(pageIndex, parentIndex, data)
+	if err != nil {
+		return err
+	}
+
+	switch pageKind(data[0]) {
+	case pageKindLeaf:
+		return nil
+	case pageKindInternal:
+		if maxDepth > 0 && depth >= maxDepth {
+			return nil
+		}
+
+		// data is reused by the children, so collect them first
+		internal := newInternalPage(pageIndex, copyBytes(data))
+		var children []uint32
+		for iter := internal.iter(); iter.hasNext(); {
+			children = append(children, iter.next().leftChildIndex)
+		}
+		children = append(children, internal.getRightChildIndex())
+
+		for _, child := range children {
+			err := db.checkSubtree(child, int32(pageIndex), depth+1, maxDepth, data, visited)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			ParentIndex: -1,
+			Expected:    "a tree page",
+			Found:       fmt.Sprintf("page kind %d", data[0]),
+		}
+	}
+}
+
+// checkParentIndex verifies that a tree page reached from parentIndex
+// records it as its parent, or is marked as the root if parentIndex is
+// -1.
+func checkParentIndex(pageIndex uint32, parentIndex int32, data []byte) error {
+	var isRootOffset, parentOffset uint32
+	switch pageKind(data[0]) {
+	case pageKindLeaf:
+		isRootOffset, parentOffset = leafPageIsRootOffset, leafPageParentIndexOffset
+	case pageKindInternal:
+		isRootOffset, parentOffset = internalPageIsRootOffset, internalPageParentIndexOffset
+	default:
+		return nil
+	}
+
+	isRoot := data[isRootOffset] == 1
+	if isRoot != (parentIndex == -1) {
+		expected := "a page marked as the root"
+		if parentIndex != -1 {
+			expected = "a page not marked as the root"
+		}
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			Offset:      isRootOffset,
+			ParentIndex: parentIndex,
+			Expected:    expected,
+			Found:       fmt.Sprintf("is root byte %d", data[isRootOffset]),
+		}
+	}
+
+	storedParent := int32(binary.LittleEndian.Uint32(data[parentOffset : parentOffset+4]))
+	if storedParent != parentIndex {
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			Offset:      parentOffset,
+			ParentIndex: parentIndex,
+			Expected:    fmt.Sprintf("parent index %d", parentIndex),
+			Found:       fmt.Sprintf("parent index %d", storedParent),
+		}
+	}
+
+	return nil
+}
+
+// checkPageOnDisk reads a page into data and verifies it.
+func (db *DB) checkPageOnDisk(pageIndex uint32, data []byte) error {
+	pageCount, err := db.bufferPool.getPageCount()
+	if err != nil {
+		return err
+	}
+	if pageIndex >= pageCount {
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			ParentIndex: -1,
+			Expected:    fmt.Sprintf("a page index below %d", pageCount),
+			Found:       fmt.Sprintf("page %d", pageIndex),
+		}
+	}
+
+	err = db.bufferPool.store.readAt(data, int64(pageIndex)*int64(defaultPageSize))
+	if err != nil {
+		return err
+	}
+
+	switch pageKind(data[0]) {
+	case pageKindHeader:
+		return checkHeaderPageData(pageIndex, data)
+	case pageKindLeaf:
+		return checkLeafPageData(pageIndex, data)
+	case pageKindInternal:
+		return checkInternalPageData(pageIndex, data)
+	}
+	return nil
+}
@@ -1,57 +1,607 @@
 package tinykv
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDatabaseFull = errors.New("database is full")
+	ErrReadOnly     = errors.New("database is open read-only")
+)
+
+// DB is a handle to an open database. Every open returns a new handle,
+// even when the database itself is shared with other handles.
 type DB struct {
+	*sharedDB
+
+	// readOnly is set if this handle was opened read-only. It shadows
+	// the field of the shared database, which may be writable through
+	// other handles.
+	readOnly bool
+
+	// closed is set once Close released this handle, guarded by
+	// openDBsMu
+	closed bool
+}
+
+// sharedDB is the state of an open database, shared by its handles.
+type sharedDB struct {
+	mu         sync.Mutex
 	bufferPool *bufferPool
+	rootIndex  uint32
+	path       string
+	temp       bool
+	keyCodec   KeyCodec
+	readOnly   bool
+	stats      Stats
+
+	// refs counts the handles returned for a shared database, sharedKey
+	// is its key in openDBs, and opts are the options it was opened with
+	refs      int
+	sharedKey string
+	opts      Options
+
+	beforeSetHooks []func(key, value []byte) error
+	commitHooks    []func(ops []Op)
+
+	writeStallThreshold time.Duration
+	writeStallHooks     []func(stall WriteStall)
+
+	// traceID is the trace ID of the operation holding the latch
+	traceID uint64
 }
 
 func OpenDB(path string) (*DB, error) {
-	bp, err := newBufferPool(path)
+	return OpenDBWithOptions(path, nil)
+}
+
+// OpenDBWithOptions opens the database at path. If the database is
+// already open in this process, the returned handle shares it instead
+// and keeps the options of the first open, so opening it with options
+// that would behave differently fails, see checkShareable.
+func OpenDBWithOptions(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+
+	err := opts.SyncMode.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedKey, err := sharedDBKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	openDBsMu.Lock()
+	defer openDBsMu.Unlock()
+
+	if shared, ok := openDBs[sharedKey]; ok {
+		err := shared.checkShareable(opts)
+		if err != nil {
+			return nil, err
+		}
+		shared.refs++
+		return &DB{sharedDB: shared, readOnly: opts.ReadOnly}, nil
+	}
+
+	store, err := openFilePageStore(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openDBWithStore(store, opts)
+	if err != nil {
+		return nil, err
+	}
+	db.path = path
+	db.opts = *opts
+	db.refs = 1
+	db.sharedKey = sharedKey
+	openDBs[sharedKey] = db.sharedDB
+
+	return db, nil
+}
+
+func openDBWithStore(store pageStore, opts *Options) (*DB, error) {
+	bp, err := newBufferPool(store, opts)
 	if err != nil {
+		store.close()
 		return nil, err
 	}
 
-	err = bp.addPage(newLeafPage(nil))
+	if len(bp.pages) == 0 {
+		// Files are created by createDBFile, only other stores can
+		// still be empty here
+		if opts.ReadOnly {
+			bp.close()
+			return nil, &CorruptionError{
+				PageIndex:   0,
+				Offset:      0,
+				ParentIndex: -1,
+				Expected:    "a header page",
+				Found:       "an empty database",
+			}
+		}
+
+		// New database, create the header and root pages
+		pages, err := newDBPages(opts)
+		if err != nil {
+			bp.close()
+			return nil, err
+		}
+		for _, page := range pages {
+			err = bp.addPage(page)
+			if err != nil {
+				bp.close()
+				return nil, err
+			}
+		}
+	}
+
+	rootIndex, err := findRootIndex(bp, opts)
 	if err != nil {
 		bp.close()
 		return nil, err
 	}
 
-	return &DB{
+	writeStallThreshold := opts.WriteStallThreshold
+	if writeStallThreshold == 0 {
+		writeStallThreshold = defaultWriteStallThreshold
+	}
+
+	db := &DB{sharedDB: &sharedDB{
 		bufferPool: bp,
-	}, nil
+		rootIndex:  rootIndex,
+		keyCodec:   opts.KeyCodec,
+		readOnly:   opts.ReadOnly,
+
+		writeStallThreshold: writeStallThreshold,
+	}, readOnly: opts.ReadOnly}
+
+	if opts.Paranoid {
+		err = db.paranoidCheck(opts.ParanoidCheckInterval)
+		if err != nil {
+			bp.close()
+			return nil, err
+		}
+	}
+
+	return db, nil
 }
 
+// newDBPages returns the initial pages of a new database: the header
+// page followed by an empty root leaf.
+func newDBPages(opts *Options) ([]page, error) {
+	header := newHeaderPage(nil)
+	header.setRootIndex(1)
+	err := header.setKeyCodecName(keyCodecName(opts.KeyCodec))
+	if err != nil {
+		return nil, err
+	}
+
+	return []page{header, newLeafPage(nil)}, nil
+}
+
+// findRootIndex reads the root page index from the header page and
+// checks that opts are compatible with the database. Databases without a
+// header page have their root at page 0.
+func findRootIndex(bp *bufferPool, opts *Options) (uint32, error) {
+	p, err := bp.getPage(0)
+	if err != nil {
+		return 0, err
+	}
+
+	header, ok := p.(*headerPage)
+	if !ok {
+		return 0, nil
+	}
+
+	err = header.validateOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	rootIndex := header.getRootIndex()
+	pageCount, err := bp.getPageCount()
+	if err != nil {
+		return 0, err
+	}
+	if rootIndex == 0 || rootIndex >= pageCount {
+		return 0, &CorruptionError{
+			PageIndex:   0,
+			Offset:      headerPageRootIndexOffset,
+			ParentIndex: -1,
+			Expected:    fmt.Sprintf("a root page index between 1 and %d", pageCount-1),
+			Found:       fmt.Sprintf("root page index %d", rootIndex),
+		}
+	}
+
+	root, err := bp.getPage(rootIndex)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := root.(treePage); !ok {
+		return 0, &CorruptionError{
+			PageIndex:   0,
+			Offset:      headerPageRootIndexOffset,
+			ParentIndex: -1,
+			Expected:    "a root page index pointing to a tree page",
+			Found:       fmt.Sprintf("root page index %d, page kind %d", rootIndex, root.getKind()),
+		}
+	}
+
+	return rootIndex, nil
+}
+
+// notTreePage is the error for a page expected to be part of the tree
+// that isn't.
+func notTreePage(pageIndex uint32, p page) error {
+	return &CorruptionError{
+		PageIndex:   pageIndex,
+		Offset:      0,
+		ParentIndex: -1,
+		Expected:    "a tree page",
+		Found:       fmt.Sprintf("page kind %d", p.getKind()),
+	}
+}
+
+// OpenTemp creates a uniquely named database in the OS temp directory.
+// The database file is removed when the returned DB is closed.
+func OpenTemp() (*DB, error) {
+	file, err := os.CreateTemp("", "tinykv-*.db")
+	if err != nil {
+		return nil, err
+	}
+	path := file.Name()
+	file.Close()
+
+	db, err := OpenDB(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	db.temp = true
+
+	return db, nil
+}
+
+// Close releases a handle to the database. The database is closed when
+// the last handle returned for its path is released. Closing a handle
+// again does nothing, so it can't release the database from under the
+// other handles.
 func (db *DB) Close() {
+	openDBsMu.Lock()
+	if db.closed {
+		openDBsMu.Unlock()
+		return
+	}
+	db.closed = true
+	if db.sharedKey != "" {
+		db.refs--
+		if db.refs > 0 {
+			openDBsMu.Unlock()
+			return
+		}
+		delete(openDBs, db.sharedKey)
+	}
+	openDBsMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	db.bufferPool.close()
+	if db.temp {
+		os.Remove(db.path)
+	}
 }
 
+// Set stores value under key. Keys and values may be empty, a nil key or
+// value is the same as an empty one.
 func (db *DB) Set(key, value []byte) error {
-	page, err := db.bufferPool.getPage(0)
+	db.lockForWrite(0)
+	defer db.mu.Unlock()
+
+	return db.set(key, value)
+}
+
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.get(key)
+}
+
+// SetContext is like Set, but attaches the trace ID carried by ctx to
+// the write's trace records and write stalls.
+func (db *DB) SetContext(ctx context.Context, key, value []byte) error {
+	db.lockForWrite(TraceIDFromContext(ctx))
+	defer db.mu.Unlock()
+	defer db.endTrace()
+
+	return db.set(key, value)
+}
+
+// GetContext is like Get, but attaches the trace ID carried by ctx to
+// the read's trace records.
+func (db *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.beginTrace(TraceIDFromContext(ctx))
+	defer db.endTrace()
+
+	return db.get(key)
+}
+
+// beginTrace marks the start of an operation run with traceID. It must
+// be called with the latch held.
+func (db *DB) beginTrace(traceID uint64) {
+	if traceID == 0 {
+		return
+	}
+	db.traceID = traceID
+	db.bufferPool.tracer.mark(traceOpBegin, traceID)
+}
+
+func (db *DB) endTrace() {
+	if db.traceID == 0 {
+		return
+	}
+	db.bufferPool.tracer.mark(traceOpEnd, db.traceID)
+	db.traceID = 0
+}
+
+// GetInto is like Get, but copies the value into the memory of dst,
+// growing it only if the value doesn't fit. It returns nil if the key
+// does not exist.
+func (db *DB) GetInto(key, dst []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	p, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, ok := p.(*leafPage)
+	if !ok {
+		tPage, ok := p.(treePage)
+		if !ok {
+			return nil, notTreePage(db.rootIndex, p)
+		}
+		value, err := tPage.findCell(db.encodeKey(key))
+		if value == nil || err != nil {
+			return nil, err
+		}
+		return appendBytes(dst, value), nil
+	}
+
+	cell, found := leaf.getCell(db.encodeKey(key))
+	if !found {
+		return nil, nil
+	}
+	return appendBytes(dst, cell.value), nil
+}
+
+// UpdateValue reads the current value of key, passes it to fn and stores
+// the value fn returns. old is nil if the key does not exist. The whole
+// read-modify-write happens under the write latch, so concurrent updates
+// to the same key are never lost. If fn returns an error nothing is
+// written and the error is returned.
+func (db *DB) UpdateValue(key []byte, fn func(old []byte) ([]byte, error)) error {
+	db.lockForWrite(0)
+	defer db.mu.Unlock()
+
+	old, err := db.get(key)
+	if err != nil {
+		return err
+	}
+
+	value, err := fn(old)
 	if err != nil {
 		return err
 	}
 
-	tPage := page.(treePage)
+	return db.set(key, value)
+}
+
+// Append adds suffix to the end of the value of key, or stores suffix as
+// its value if key doesn't exist. The value is extended in place when its
+// page has room and no hooks are registered, otherwise the whole value
+// is rewritten, which is what the hooks are called with.
+func (db *DB) Append(key, suffix []byte) error {
+	db.lockForWrite(0)
+	defer db.mu.Unlock()
 
-	if foundValue, _ := tPage.findCell(key); foundValue != nil {
-		panic("TODO: can't replace cells yet")
+	if db.readOnly {
+		return ErrReadOnly
 	}
 
-	err = tPage.addCell(key, value)
+	if len(db.beforeSetHooks) == 0 && len(db.commitHooks) == 0 {
+		appended, err := db.appendInPlace(key, suffix)
+		if err != nil || appended {
+			return err
+		}
+	}
+
+	old, err := db.get(key)
 	if err != nil {
 		return err
 	}
+	value := make([]byte, 0, len(old)+len(suffix))
+	value = append(append(value, old...), suffix...)
+
+	return db.set(key, value)
+}
+
+// appendInPlace extends the value of an existing key inside its page. It
+// reports whether it did, which it can't if the key doesn't exist or its
+// page is full.
+func (db *DB) appendInPlace(key, suffix []byte) (bool, error) {
+	defer db.checkBufferPoolStalls(db.stallTimes())
+
+	p, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		return false, err
+	}
+
+	leaf, ok := p.(*leafPage)
+	if !ok {
+		return false, nil
+	}
+
+	cell, found := leaf.getCell(db.encodeKey(key))
+	if !found || uint32(len(suffix)) > leaf.getFreeSpace() {
+		return false, nil
+	}
+	valueLen := len(cell.value) + len(suffix)
+	leaf.appendToCell(cell, suffix)
+
+	db.stats.Commits++
+	db.stats.UserBytesWritten += uint64(len(key) + len(suffix))
+	return true, db.recordWriteSizes(len(key), valueLen)
+}
+
+// DeleteRange removes the keys in [start, end) and returns how many were
+// removed. A nil start or end leaves that side unbounded, like in
+// GetRange. OnBeforeSet hooks aren't called for deletions.
+func (db *DB) DeleteRange(start, end []byte) (int, error) {
+	db.lockForWrite(0)
+	defer db.mu.Unlock()
+
+	return db.deleteRange(start, end)
+}
+
+// DeletePrefix removes the keys starting with prefix and returns how
+// many were removed. Like in GetRange, stored keys the KeyCodec can't
+// decode are skipped, so with HashedKeyCodec keys longer than its maxLen
+// are never removed, and a prefix longer than maxLen matches nothing.
+func (db *DB) DeletePrefix(prefix []byte) (int, error) {
+	db.lockForWrite(0)
+	defer db.mu.Unlock()
+
+	return db.deleteRange(prefix, prefixEnd(prefix))
+}
+
+func (db *DB) deleteRange(start, end []byte) (int, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	defer db.checkBufferPoolStalls(db.stallTimes())
+
+	p, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		return 0, err
+	}
+	leaf, ok := p.(*leafPage)
+	if !ok {
+		return 0, errors.New("deleting from internal pages is not supported")
+	}
+
+	// Cells are removed last to first, so removing one doesn't move the
+	// ones still to be removed
+	var cells []leafCell
+	var ops []Op
+	err = db.scanCells(start, end, func(pageIndex uint32, cell leafCell, key []byte) bool {
+		cells = append(cells, cell)
+		if len(db.commitHooks) > 0 {
+			ops = append(ops, Op{Key: copyBytes(key), Delete: true})
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := len(cells) - 1; i >= 0; i-- {
+		leaf.removeCellAt(cells[i])
+	}
+
+	if len(cells) > 0 {
+		db.stats.Commits++
+		if len(ops) > 0 {
+			db.runCommitHooks(ops)
+		}
+	}
+
+	return len(cells), nil
+}
+
+func (db *DB) set(key, value []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	err := db.runBeforeSetHooks(key, value)
+	if err != nil {
+		return err
+	}
+
+	defer db.checkBufferPoolStalls(db.stallTimes())
+
+	page, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		return err
+	}
+
+	tPage, ok := page.(treePage)
+	if !ok {
+		return notTreePage(db.rootIndex, page)
+	}
+
+	err = tPage.addCell(db.encodeKey(key), value)
+	if err != nil {
+		return err
+	}
+
+	db.stats.Commits++
+	db.stats.UserBytesWritten += uint64(len(key) + len(value))
+	err = db.recordWriteSizes(len(key), len(value))
+	if err != nil {
+		return err
+	}
+
+	if len(db.commitHooks) > 0 {
+		// Only built when needed, it escapes to the hooks
+		db.runCommitHooks([]Op{{Key: key, Value: value}})
+	}
 
 	return nil
 }
 
-func (db *DB) Get(key []byte) ([]byte, error) {
-	page, err := db.bufferPool.getPage(0)
+func (db *DB) get(key []byte) ([]byte, error) {
+	page, err := db.bufferPool.getPage(db.rootIndex)
 	if err != nil {
 		return nil, err
 	}
 
-	tPage := page.(treePage)
+	tPage, ok := page.(treePage)
+	if !ok {
+		return nil, notTreePage(db.rootIndex, page)
+	}
+
+	return tPage.findCell(db.encodeKey(key))
+}
 
-	return tPage.findCell(key)
+// getHeaderPage returns the header page, which isn't kept around since
+// the buffer pool may evict it.
+func (db *DB) getHeaderPage() (*headerPage, error) {
+	p, err := db.bufferPool.getPage(0)
+	if err != nil {
+		return nil, err
+	}
+	return p.(*headerPage), nil
+}
+
+func (db *DB) encodeKey(key []byte) []byte {
+	if db.keyCodec == nil {
+		return key
+	}
+	return db.keyCodec.EncodeKey(key)
 }
@@ -2,8 +2,16 @@ package tinykv
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 const (
@@ -62,6 +70,7 @@ func TestSimple(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
 
 	checkFound([]byte("hello1"), []byte("world1"))
 	checkFound([]byte("hello2"), []byte("world2"))
@@ -72,3 +81,2006 @@ func TestSimple(t *testing.T) {
 	// 	t.Fatal(err)
 	// }
 }
+
+func TestOpenTemp(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := db.path
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Set([]byte("hello"), []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("wrong value found, expected 'world'")
+	}
+
+	db.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("temporary database '%s' was not removed on close", path)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+	db.Set([]byte("c"), []byte("3"))
+
+	err = db.Set([]byte("b"), []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{"a": "1", "b": "two", "c": "3"} {
+		foundValue, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(foundValue, []byte(value)) {
+			t.Errorf("wrong value found for key '%s', expected '%s'", key, value)
+		}
+	}
+}
+
+func TestUpdateValue(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte("counter")
+	increment := func(old []byte) ([]byte, error) {
+		if old == nil {
+			return []byte{1}, nil
+		}
+		return []byte{old[0] + 1}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.UpdateValue(key, increment); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 1 || value[0] != 100 {
+		t.Errorf("expected counter to be 100, got %v", value)
+	}
+
+	fail := errors.New("fail")
+	err = db.UpdateValue(key, func(old []byte) ([]byte, error) {
+		return nil, fail
+	})
+	if err != fail {
+		t.Errorf("expected UpdateValue to return the callback error, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("hello1"), []byte("world1"))
+	db.Set([]byte("hello2"), []byte("world2"))
+
+	var buf bytes.Buffer
+	err = db.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.PageCount != 2 {
+		t.Errorf("expected 2 pages in backup, got %d", manifest.PageCount)
+	}
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff
+	_, err = VerifyBackup(bytes.NewReader(corrupted))
+	if err == nil {
+		t.Errorf("expected corrupted backup to fail verification")
+	}
+
+	_, err = VerifyBackup(bytes.NewReader(corrupted[:len(corrupted)-1]))
+	if err == nil {
+		t.Errorf("expected truncated backup to fail verification")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rejected := errors.New("rejected")
+	db.OnBeforeSet(func(key, value []byte) error {
+		if len(value) == 0 {
+			return rejected
+		}
+		return nil
+	})
+
+	var committed []string
+	db.OnCommit(func(ops []Op) {
+		for _, op := range ops {
+			committed = append(committed, string(op.Key)+"="+string(op.Value))
+		}
+	})
+
+	err = db.Set([]byte("hello"), []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Set([]byte("empty"), []byte{})
+	if err != rejected {
+		t.Errorf("expected write to be rejected by hook, got %v", err)
+	}
+
+	value, err := db.Get([]byte("empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Errorf("rejected write was applied")
+	}
+
+	if len(committed) != 1 || committed[0] != "hello=world" {
+		t.Errorf("unexpected committed ops: %v", committed)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	cleanDB()
+
+	_, err := OpenDBWithOptions(DB_PATH, &Options{MaxSize: 2*int64(defaultPageSize) - 1})
+	if err != ErrDatabaseFull {
+		t.Fatalf("expected ErrDatabaseFull, got %v", err)
+	}
+
+	cleanDB()
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{MaxSize: 2 * int64(defaultPageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("hello"), []byte("world"))
+	db.Close()
+
+	// Reopening a database that is already at its maximum size must not
+	// need to grow the file
+	db, err = OpenDBWithOptions(DB_PATH, &Options{MaxSize: 2 * int64(defaultPageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value, err := db.Get([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("wrong value found, expected 'world'")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	cleanDB()
+
+	var trace bytes.Buffer
+	db, err := OpenDBWithOptions(DB_PATH, &Options{Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("hello1"), []byte("world1"))
+	db.Set([]byte("hello2"), []byte("world2"))
+	db.Close()
+
+	db, err = OpenDBWithOptions(DB_PATH, &Options{Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Get([]byte("hello1"))
+	db.Get([]byte("hello2"))
+	db.Close()
+
+	records, err := ReadTrace(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := SummarizeTrace(records)
+	// Each open reads the header and root pages from disk and writes both
+	// back on close. Sets hit the root page and the header page to update
+	// the size histograms, gets hit the root page.
+	if report.Hits != 6 || report.Reads != 4 || report.Writes != 4 {
+		t.Errorf("unexpected trace counts: %d hits, %d reads, %d writes",
+			report.Hits, report.Reads, report.Writes)
+	}
+	if len(report.Pages) != 2 {
+		t.Errorf("expected accesses to the header and root pages, got %v", report.Pages)
+	}
+	if report.ReadAmplification() != 0.4 {
+		t.Errorf("expected read amplification of 0.4, got %f", report.ReadAmplification())
+	}
+}
+
+func TestIOOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{DirectIO: true},
+		{SyncMode: SyncData},
+		{SyncMode: SyncFull},
+		{DirectIO: true, SyncMode: SyncFull},
+	} {
+		cleanDB()
+
+		db, err := OpenDBWithOptions(DB_PATH, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Set([]byte("hello"), []byte("world"))
+		db.Close()
+
+		db, err = OpenDBWithOptions(DB_PATH, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := db.Get([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte("world")) {
+			t.Errorf("wrong value found with options %+v, expected 'world'", opts)
+		}
+
+		// Pages read from disk can be used for direct I/O as they are
+		for pageIndex, p := range db.bufferPool.pages {
+			if p != nil && !isAligned(p.getData()) {
+				t.Errorf("page %d isn't aligned with options %+v", pageIndex, opts)
+			}
+		}
+
+		db.Close()
+	}
+
+	for _, p := range []page{newHeaderPage(nil), newLeafPage(nil), newInternalPage(0, nil)} {
+		if !isAligned(p.getData()) {
+			t.Errorf("new page of kind %d isn't aligned", p.getKind())
+		}
+	}
+
+	// An invalid sync mode is rejected before anything is created
+	cleanDB()
+	_, err := OpenDBWithOptions(DB_PATH, &Options{SyncMode: SyncFull + 1})
+	if err == nil {
+		t.Errorf("expected an invalid sync mode to be rejected")
+	}
+	if _, err := os.Stat(DB_PATH); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no database to be created, got %v", err)
+	}
+}
+
+func TestKeyCodec(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{KeyCodec: NamespaceKeyCodec([]byte("tenant1/"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("hello"), []byte("world"))
+
+	root, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := root.(*leafPage).findCell([]byte("tenant1/hello"))
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("key was not stored with its namespace")
+	}
+	db.Close()
+
+	// The codec is recorded in the header, opening with another one fails
+	_, err = OpenDB(DB_PATH)
+	if err == nil || !strings.Contains(err.Error(), "created with key codec") {
+		t.Errorf("expected opening without the key codec to fail, got %v", err)
+	}
+
+	cleanDB()
+	codec := HashedKeyCodec(8)
+	db, err = OpenDBWithOptions(DB_PATH, &Options{KeyCodec: codec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	longKey := bytes.Repeat([]byte("k"), 100)
+	db.Set(longKey, []byte("long"))
+	value, err = db.Get(longKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("long")) {
+		t.Errorf("wrong value found for hashed key")
+	}
+
+	if _, ok := codec.DecodeKey(codec.EncodeKey(longKey)); ok {
+		t.Errorf("hashed key should not be decodable")
+	}
+	if key, ok := codec.DecodeKey(codec.EncodeKey([]byte("short"))); !ok || string(key) != "short" {
+		t.Errorf("short key should round trip through the codec")
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	v1 := NewVersioned(1)
+	v1.Set(db, []byte("user"), []byte("alice"))
+
+	v3 := NewVersioned(3)
+	v3.RegisterUpgrade(1, func(old []byte) ([]byte, error) {
+		return append([]byte("name="), old...), nil
+	})
+	v3.RegisterUpgrade(2, func(old []byte) ([]byte, error) {
+		return append(old, []byte(";age=0")...), nil
+	})
+
+	value, err := v3.Get(db, []byte("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "name=alice;age=0" {
+		t.Errorf("value was not upgraded, got '%s'", string(value))
+	}
+
+	stored, _ := db.Get([]byte("user"))
+	if stored[0] != 1 {
+		t.Errorf("value should not be rewritten without RewriteOnRead")
+	}
+
+	v3.RewriteOnRead = true
+	value, err = v3.Get(db, []byte("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "name=alice;age=0" {
+		t.Errorf("value was not upgraded, got '%s'", string(value))
+	}
+
+	stored, _ = db.Get([]byte("user"))
+	if stored[0] != 3 {
+		t.Errorf("value should be rewritten with the latest version, got version %d", stored[0])
+	}
+
+	value, err = v3.Get(db, []byte("missing"))
+	if err != nil || value != nil {
+		t.Errorf("expected nil value for missing key, got '%s' (%v)", string(value), err)
+	}
+
+	_, err = v1.Get(db, []byte("user"))
+	if err == nil {
+		t.Errorf("expected error reading a value newer than the latest version")
+	}
+}
+
+func TestVersionedReadOnly(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewVersioned(1).Set(db, []byte("user"), []byte("alice"))
+	db.Close()
+
+	db, err = OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	v2 := NewVersioned(2)
+	v2.RegisterUpgrade(1, func(old []byte) ([]byte, error) {
+		return append([]byte("name="), old...), nil
+	})
+	v2.RewriteOnRead = true
+
+	value, err := v2.Get(db, []byte("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "name=alice" {
+		t.Errorf("value was not upgraded, got '%s'", string(value))
+	}
+
+	stored, _ := db.Get([]byte("user"))
+	if stored[0] != 1 {
+		t.Errorf("read-only value should not be rewritten, got version %d", stored[0])
+	}
+}
+
+func TestFragmentationReport(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("hello1"), []byte("world1"))
+	db.Set([]byte("hello2"), []byte("world2"))
+
+	report, err := db.FragmentationReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Levels) != 1 {
+		t.Fatalf("expected a single level, got %d", len(report.Levels))
+	}
+	root := report.Levels[0]
+	if root.Pages != 1 || root.Cells != 2 {
+		t.Errorf("expected 1 page with 2 cells, got %d pages with %d cells", root.Pages, root.Cells)
+	}
+	expectedUsed := int64(leafPageFirstCellOffset + 2*getLeafNodeCellSize(6, 6))
+	if root.UsedBytes != expectedUsed {
+		t.Errorf("expected %d used bytes, got %d", expectedUsed, root.UsedBytes)
+	}
+	if report.ReclaimableBytes != 0 {
+		t.Errorf("expected nothing to reclaim, got %d bytes", report.ReclaimableBytes)
+	}
+}
+
+func TestVisualizeHTML(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("hello"), []byte("<world>"))
+	db.Set([]byte("\x00\xff"), []byte{})
+
+	var out bytes.Buffer
+	err = visualizeDBHTML(db, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(out.Bytes(), []byte("&#34;hello&#34; = &#34;&lt;world&gt;&#34;")) {
+		t.Errorf("cell missing from rendered HTML:\n%s", out.String())
+	}
+	// Binary keys are rendered as hex
+	if !bytes.Contains(out.Bytes(), []byte("0x00ff = (empty)")) {
+		t.Errorf("binary cell missing from rendered HTML:\n%s", out.String())
+	}
+
+	// Printable keys can't be mistaken for binary or empty ones
+	for _, tc := range []struct {
+		b        []byte
+		rendered string
+	}{
+		{[]byte("0x00ff"), `"0x00ff"`},
+		{[]byte{0x00, 0xff}, `0x00ff`},
+		{[]byte("(empty)"), `"(empty)"`},
+		{nil, `(empty)`},
+	} {
+		if rendered := displayBytes(tc.b); rendered != tc.rendered {
+			t.Errorf("expected %q to render as %s, got %s", tc.b, tc.rendered, rendered)
+		}
+	}
+}
+
+func TestHeatMap(t *testing.T) {
+	heat := newHeatMap(map[uint32]int{0: 2, 1: 4})
+	for _, tc := range []struct {
+		pageIndex uint32
+		color     string
+	}{
+		{1, "#ff4040"},
+		{0, "#e98a8a"},
+		{2, "#d3d3d3"},
+	} {
+		if color := heat.color(tc.pageIndex); color != tc.color {
+			t.Errorf("page %d: expected color %s, got %s", tc.pageIndex, tc.color, color)
+		}
+	}
+
+	cleanDB()
+	var trace bytes.Buffer
+	db, err := OpenDBWithOptions(DB_PATH, &Options{Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("hello"), []byte("world"))
+	accesses := newHeatMap(db.bufferPool.tracer.accesses).accesses
+	for i := 0; i < 5; i++ {
+		db.Get([]byte("hello"))
+	}
+
+	heat = newHeatMap(db.bufferPool.tracer.accesses)
+	if heat.accesses[db.rootIndex] != accesses[db.rootIndex]+5 {
+		t.Errorf("expected %d root accesses, got %d", accesses[db.rootIndex]+5, heat.accesses[db.rootIndex])
+	}
+	if heat.accesses[0] != accesses[0] {
+		t.Errorf("gets shouldn't access the header page, got %d accesses", heat.accesses[0]-accesses[0])
+	}
+	if heat.color(db.rootIndex) != "#ff4040" {
+		t.Errorf("expected the root page to be the hottest, got %s", heat.color(db.rootIndex))
+	}
+
+	graph, err := visualizeDBDot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := fmt.Sprintf("\\n%d accesses", heat.accesses[db.rootIndex])
+	if !strings.Contains(graph, `color="#ff4040"`) || !strings.Contains(graph, label) {
+		t.Errorf("heat missing from dot output:\n%s", graph)
+	}
+
+	// The root is loaded if it isn't cached
+	err = db.DropCaches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err = visualizeDBDot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(graph, `\"hello\" = \"world\"`) {
+		t.Errorf("cell missing from dot output after dropping caches:\n%s", graph)
+	}
+
+	var out bytes.Buffer
+	err = visualizeDBHTML(db, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := fmt.Sprintf(`<summary style="background: #ff4040">Leaf page %d`, db.rootIndex)
+	if !bytes.Contains(out.Bytes(), []byte(summary)) {
+		t.Errorf("heat missing from rendered HTML:\n%s", out.String())
+	}
+}
+
+func TestCorruptionError(t *testing.T) {
+	corrupt := func(offset int64, data []byte) error {
+		cleanDB()
+
+		db, err := OpenDB(DB_PATH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Set([]byte("hello1"), []byte("world1"))
+		db.Set([]byte("hello2"), []byte("world2"))
+		db.Close()
+
+		file, err := os.OpenFile(DB_PATH, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt(data, offset)
+		file.Close()
+
+		db, err = OpenDB(DB_PATH)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		_, err = db.Get([]byte("hello1"))
+		return err
+	}
+
+	var corruptionErr *CorruptionError
+	root := int64(defaultPageSize)
+
+	err := corrupt(headerPageMagicOffset, []byte("XXXX"))
+	if !errors.As(err, &corruptionErr) || corruptionErr.PageIndex != 0 || corruptionErr.Offset != headerPageMagicOffset {
+		t.Errorf("expected corruption error for invalid header magic, got %v", err)
+	}
+
+	err = corrupt(root, []byte{0xff})
+	if !errors.As(err, &corruptionErr) || corruptionErr.PageIndex != 1 || corruptionErr.Offset != 0 {
+		t.Errorf("expected corruption error for invalid page kind, got %v", err)
+	}
+
+	for _, rootIndex := range []byte{0, 99} {
+		err = corrupt(headerPageRootIndexOffset, []byte{rootIndex, 0, 0, 0})
+		if !errors.As(err, &corruptionErr) || corruptionErr.PageIndex != 0 || corruptionErr.Offset != headerPageRootIndexOffset {
+			t.Errorf("expected corruption error for root page index %d, got %v", rootIndex, err)
+		}
+	}
+
+	// Kinds that are valid but can't be loaded yet must not crash either
+	for _, kind := range []pageKind{pageKindUnallocated, pageKindInternal} {
+		err = corrupt(root, []byte{byte(kind)})
+		if !errors.As(err, &corruptionErr) || corruptionErr.PageIndex != 1 || corruptionErr.Offset != 0 {
+			t.Errorf("expected corruption error for page kind %d, got %v", kind, err)
+		}
+
+	}
+
+	err = corrupt(root+leafPageFirstCellOffset, []byte{0xff, 0xff, 0, 0})
+	if !errors.As(err, &corruptionErr) || corruptionErr.Offset != leafPageFirstCellOffset {
+		t.Errorf("expected corruption error for invalid key length, got %v", err)
+	}
+
+	// Swap the last byte of the first key so the keys are out of order
+	err = corrupt(root+leafPageFirstCellOffset+4+5, []byte("3"))
+	if !errors.As(err, &corruptionErr) {
+		t.Errorf("expected corruption error for unsorted keys, got %v", err)
+	}
+}
+
+func TestWriteAmplification(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The database file is created before the buffer pool is
+	stats := db.Stats()
+	if stats.DiskBytesWritten != 0 {
+		t.Errorf("expected no bytes written on creation, got %d", stats.DiskBytesWritten)
+	}
+
+	for i := 0; i < 64; i++ {
+		db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	var buf bytes.Buffer
+	err = db.Backup(&buf) // Flushes the header and root pages
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = db.Stats()
+	if stats.Commits != 64 {
+		t.Errorf("expected 64 commits, got %d", stats.Commits)
+	}
+	if stats.UserBytesWritten != 64*10 {
+		t.Errorf("expected %d user bytes written, got %d", 64*10, stats.UserBytesWritten)
+	}
+	if stats.DiskBytesWritten != 2*uint64(defaultPageSize) {
+		t.Errorf("expected %d disk bytes written, got %d", 2*defaultPageSize, stats.DiskBytesWritten)
+	}
+	expected := float64(2*defaultPageSize) / float64(64*10)
+	if stats.WriteAmplification() != expected {
+		t.Errorf("expected write amplification %f, got %f", expected, stats.WriteAmplification())
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	keys := func(pairs []KV) string {
+		var sb bytes.Buffer
+		for _, pair := range pairs {
+			sb.Write(pair.Key)
+			sb.WriteByte(' ')
+		}
+		return sb.String()
+	}
+
+	pairs, next, err := db.GetRange([]byte("key2"), []byte("key5"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys(pairs) != "key2 key3 key4 " || next != nil {
+		t.Errorf("unexpected range: %s, next %q", keys(pairs), next)
+	}
+
+	pairs, next, err = db.GetRange(nil, nil, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys(pairs) != "key0 key1 key2 " || string(next) != "key3" {
+		t.Errorf("unexpected limited range: %s, next %q", keys(pairs), next)
+	}
+
+	// Each pair is 10 bytes, so a budget of 25 bytes fits two of them
+	pairs, next, err = db.GetRange(next, nil, 0, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys(pairs) != "key3 key4 " || string(next) != "key5" {
+		t.Errorf("unexpected byte limited range: %s, next %q", keys(pairs), next)
+	}
+
+	// A single pair over the budget is still returned
+	pairs, _, err = db.GetRange(nil, nil, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys(pairs) != "key0 " {
+		t.Errorf("expected a single pair, got %s", keys(pairs))
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a/1"), []byte("keep"))
+	db.Set([]byte("a/2"), []byte("drop"))
+	db.Set([]byte("a/3"), []byte("keep"))
+	db.Set([]byte("b/1"), []byte("keep"))
+	db.Set([]byte("a\xff"), []byte("keep"))
+
+	var found []string
+	err = db.ScanFilter([]byte("a/"), func(key, value []byte) bool {
+		return bytes.Equal(value, []byte("keep"))
+	}, func(key, value []byte) error {
+		found = append(found, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0] != "a/1" || found[1] != "a/3" {
+		t.Errorf("unexpected scan result: %v", found)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = db.ScanFilter(nil, nil, func(key, value []byte) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("expected scan to stop at the first error, got %v after %d pairs", err, count)
+	}
+
+	if end := prefixEnd([]byte("a\xff\xff")); !bytes.Equal(end, []byte("b")) {
+		t.Errorf("wrong prefix end: %q", end)
+	}
+	if end := prefixEnd([]byte("\xff")); end != nil {
+		t.Errorf("expected no prefix end, got %q", end)
+	}
+}
+
+func TestScanProject(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("user/1"), EncodeFields([]byte("alice"), []byte("alice@example.com"), []byte("30")))
+	db.Set([]byte("user/2"), EncodeFields([]byte("bob")))
+
+	var found []string
+	err = db.ScanProject([]byte("user/"), LengthPrefixedLayout, []int{2, 0}, func(key []byte, fields [][]byte) error {
+		found = append(found, fmt.Sprintf("%s:%q,%q", key, fields[0], fields[1]))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{`user/1:"30","alice"`, `user/2:"","bob"`}
+	if len(found) != 2 || found[0] != expected[0] || found[1] != expected[1] {
+		t.Errorf("unexpected projection: %v", found)
+	}
+
+	// Length prefixes running past the end of the value are corruption
+	for _, value := range [][]byte{{0xff, 0xff, 0xff, 0xff, 'x'}, {1, 0}} {
+		db.Set([]byte("user/3"), value)
+		err = db.ScanProject([]byte("user/"), LengthPrefixedLayout, []int{0}, func(key []byte, fields [][]byte) error {
+			return nil
+		})
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) || corruption.PageIndex != db.rootIndex {
+			t.Errorf("value %x: expected a CorruptionError in the root page, got %v", value, err)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{MemoryLimit: 2 * int64(defaultPageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bp := db.bufferPool
+	for i := 0; i < 3; i++ {
+		err := bp.addPage(newLeafPage(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Evict everything by loading each page in turn, changing a page
+	// before it is evicted must not lose the change
+	for pageIndex := db.rootIndex; pageIndex < db.rootIndex+4; pageIndex++ {
+		p, err := bp.getPage(pageIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.(*leafPage).addCell([]byte("page"), []byte{byte(pageIndex)})
+	}
+
+	usage := db.MemoryUsage()
+	if usage.CachedPages != 2 || usage.BufferPoolBytes != 2*int64(defaultPageSize) {
+		t.Errorf("expected 2 cached pages, got %d (%d bytes)", usage.CachedPages, usage.BufferPoolBytes)
+	}
+
+	for pageIndex := db.rootIndex; pageIndex < db.rootIndex+4; pageIndex++ {
+		p, err := bp.getPage(pageIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := p.(*leafPage).findCell([]byte("page"))
+		if !bytes.Equal(value, []byte{byte(pageIndex)}) {
+			t.Errorf("change to page %d was lost on eviction", pageIndex)
+		}
+	}
+}
+
+func TestParseMemoryLimits(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected int64
+	}{
+		{"max\n", 0},
+		{"536870912\n", 536870912},
+		{"9223372036854771712\n", 0},
+		{"garbage", 0},
+	}
+	for _, c := range cases {
+		if limit := parseCgroupLimit([]byte(c.data)); limit != c.expected {
+			t.Errorf("parseCgroupLimit(%q) = %d, expected %d", c.data, limit, c.expected)
+		}
+	}
+
+	meminfo := "MemTotal:       16318412 kB\nMemFree:         1283044 kB\n"
+	if total := parseMemTotal([]byte(meminfo)); total != 16318412*1024 {
+		t.Errorf("wrong MemTotal parsed: %d", total)
+	}
+}
+
+func TestOpenExistenceOptions(t *testing.T) {
+	cleanDB()
+
+	_, err := OpenDBWithOptions(DB_PATH, &Options{MustExist: true})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected missing database to fail with MustExist, got %v", err)
+	}
+	if _, err := os.Stat(DB_PATH); !os.IsNotExist(err) {
+		t.Errorf("MustExist created the database file")
+	}
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{ErrorIfExists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = OpenDBWithOptions(DB_PATH, &Options{ErrorIfExists: true})
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected existing database to fail with ErrorIfExists, got %v", err)
+	}
+
+	db, err = OpenDBWithOptions(DB_PATH, &Options{MustExist: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = OpenDBWithOptions(DB_PATH, &Options{MustExist: true, ErrorIfExists: true})
+	if err == nil {
+		t.Errorf("expected conflicting options to fail")
+	}
+}
+
+func TestCreateLeavesNoTempFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tinykv-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test.db"
+	db, err := OpenDBWithOptions(path, &Options{SyncMode: SyncFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "test.db" {
+		t.Errorf("expected only the database file, found %v", entries)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*int64(defaultPageSize) {
+		t.Errorf("expected a database with a header and a root page, got %d bytes", info.Size())
+	}
+}
+
+func TestOpenEmptyFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tinykv-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test.db"
+	err = os.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDBWithOptions(path, &Options{ReadOnly: true})
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Errorf("expected a read-only open of an empty file to fail with a CorruptionError, got %v", err)
+	}
+
+	// An empty file is replaced like a missing one is created
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "test.db" {
+		t.Errorf("expected only the database file, found %v", entries)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*int64(defaultPageSize) {
+		t.Errorf("expected a database with a header and a root page, got %d bytes", info.Size())
+	}
+}
+
+func TestSharedHandles(t *testing.T) {
+	cleanDB()
+
+	db1, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := OpenDB("/tmp/../tmp/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db1 == db2 || db1.sharedDB != db2.sharedDB {
+		t.Fatalf("expected a new handle to the already open database")
+	}
+
+	_, err = OpenDBWithOptions(DB_PATH, &Options{KeyCodec: NamespaceKeyCodec([]byte("x"))})
+	if err == nil {
+		t.Errorf("expected sharing with a different key codec to fail")
+	}
+
+	// Options that would behave differently can't be shared
+	for _, opts := range []Options{
+		{MaxSize: 1 << 20},
+		{SyncMode: SyncFull},
+		{MemoryLimit: 1 << 20},
+		{Paranoid: true},
+		{Trace: &bytes.Buffer{}},
+	} {
+		_, err = OpenDBWithOptions(DB_PATH, &opts)
+		if err == nil {
+			t.Errorf("expected sharing with options %+v to fail", opts)
+		}
+	}
+	// Read-only handles never write, so the write options don't matter
+	db4, err := OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true, SyncMode: SyncFull, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db4.Close()
+
+	db1.Set([]byte("hello"), []byte("world"))
+	db1.Close()
+	// Closing a handle twice must not close the database under db2
+	db1.Close()
+
+	// The database stays open until the last handle is closed
+	value, err := db2.Get([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("wrong value found, expected 'world'")
+	}
+	db2.Close()
+
+	db3, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db3.Close()
+	if db3.sharedDB == db1.sharedDB {
+		t.Errorf("expected a new database after all handles were closed")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cleanDB()
+
+	_, err := OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected read-only open of a missing database to fail, got %v", err)
+	}
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("hello"), []byte("world"))
+	db.Close()
+
+	before, err := os.ReadFile(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only access must work without write permission on the file
+	os.Chmod(DB_PATH, 0400)
+	defer os.Chmod(DB_PATH, 0600)
+
+	db, err = OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("wrong value found, expected 'world'")
+	}
+
+	err = db.Set([]byte("hello"), []byte("changed"))
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	db.Close()
+
+	after, err := os.ReadFile(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("read-only handle modified the database file")
+	}
+}
+
+func TestReadOnlyAlongsideWriter(t *testing.T) {
+	cleanDB()
+
+	writer, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Set([]byte("hello"), []byte("world"))
+
+	reader, err := OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reader.Set([]byte("hello"), []byte("changed"))
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	// The reader sees the writer's writes, including the ones made after
+	// it was opened
+	writer.Set([]byte("later"), []byte("value"))
+	for key, expected := range map[string]string{"hello": "world", "later": "value"} {
+		value, err := reader.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Errorf("expected '%s' for key '%s', got '%s'", expected, key, string(value))
+		}
+	}
+
+	// The writer keeps working after the reader is closed
+	reader.Close()
+	err = writer.Set([]byte("hello"), []byte("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	reader, err = OpenDBWithOptions(DB_PATH, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// A database opened read-only can't be shared with a writer
+	_, err = OpenDB(DB_PATH)
+	if err == nil {
+		t.Errorf("expected a writable open of a read-only database to fail")
+	}
+}
+
+func TestSizeHistograms(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("a"), []byte(""))
+	db.Set([]byte("abc"), []byte(strings.Repeat("v", 100)))
+	db.Close()
+
+	// The histograms persist across opens
+	db, err = OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Set([]byte("abcd"), []byte(strings.Repeat("v", 100)))
+
+	// The histograms of a returned Stats can be used without a variable
+	if count := db.Stats().KeySizes.Count(); count != 3 {
+		t.Errorf("expected 3 key sizes recorded, got %d", count)
+	}
+
+	stats := db.Stats()
+	if stats.KeySizes.Count() != 3 || stats.ValueSizes.Count() != 3 {
+		t.Fatalf("expected 3 sizes recorded, got %d keys and %d values",
+			stats.KeySizes.Count(), stats.ValueSizes.Count())
+	}
+	if stats.KeySizes[1] != 1 || stats.KeySizes[2] != 1 || stats.KeySizes[3] != 1 {
+		t.Errorf("unexpected key size buckets: %v", stats.KeySizes)
+	}
+	if stats.ValueSizes[0] != 1 || stats.ValueSizes[7] != 2 {
+		t.Errorf("unexpected value size buckets: %v", stats.ValueSizes)
+	}
+	if p := stats.ValueSizes.Percentile(50); p != 127 {
+		t.Errorf("expected a median value size of at most 127, got %d", p)
+	}
+	if p := stats.KeySizes.Percentile(100); p != 7 {
+		t.Errorf("expected a largest key size of at most 7, got %d", p)
+	}
+}
+
+func TestWriteStalls(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{WriteStallThreshold: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var stalls []WriteStall
+	db.OnWriteStall(func(stall WriteStall) {
+		stalls = append(stalls, stall)
+	})
+
+	// Hold the latch for longer than the threshold while another write
+	// waits for it
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		db.UpdateValue([]byte("slow"), func(old []byte) ([]byte, error) {
+			close(locked)
+			time.Sleep(20 * time.Millisecond)
+			return []byte("value"), nil
+		})
+		close(done)
+	}()
+
+	<-locked
+	err = db.Set([]byte("fast"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(stalls) != 1 || stalls[0].Cause != StallLatch || stalls[0].Duration <= 5*time.Millisecond {
+		t.Fatalf("expected a single latch stall, got %v", stalls)
+	}
+
+	stats := db.Stats()
+	if stats.WriteStalls != 1 || stats.WriteStallTime != stalls[0].Duration {
+		t.Errorf("unexpected write stall stats: %d stalls, %v", stats.WriteStalls, stats.WriteStallTime)
+	}
+}
+
+func TestDropCaches(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("hello"), []byte("world"))
+
+	err = db.DropCaches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := db.MemoryUsage(); usage.CachedPages != 0 {
+		t.Errorf("expected no cached pages, got %d", usage.CachedPages)
+	}
+
+	value, err := db.Get([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("write was lost when dropping caches, got %q", value)
+	}
+}
+
+func TestPrefixStats(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("users/1"), []byte("alice"))
+	db.Set([]byte("users/2"), []byte("bob"))
+	db.Set([]byte("logs/2024/1"), []byte(strings.Repeat("x", 100)))
+	db.Set([]byte("logs/2025/1"), []byte("y"))
+	db.Set([]byte("u"), []byte(""))
+
+	stats, err := db.PrefixStats(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || string(stats[0].Prefix) != "lo" || stats[0].Keys != 2 || stats[0].ValueBytes != 101 {
+		t.Fatalf("unexpected prefix stats: %+v", stats)
+	}
+	if string(stats[1].Prefix) != "us" || stats[1].KeyBytes != 14 || string(stats[2].Prefix) != "u" {
+		t.Errorf("unexpected prefix stats: %+v", stats)
+	}
+
+	stats, err = db.DelimitedPrefixStats('/', 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes []string
+	for _, s := range stats {
+		prefixes = append(prefixes, string(s.Prefix))
+	}
+	expected := []string{"logs/2024/", "logs/2025/", "users/1", "users/2", "u"}
+	if strings.Join(prefixes, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected prefixes %v, got %v", expected, prefixes)
+	}
+
+	for _, depth := range []int{0, -1} {
+		if _, err := db.PrefixStats(depth); err == nil {
+			t.Errorf("expected an error for depth %d", depth)
+		}
+		if _, err := db.DelimitedPrefixStats('/', depth); err == nil {
+			t.Errorf("expected an error for depth %d with a delimiter", depth)
+		}
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Set(nil, []byte("empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("a"), []byte("a"))
+
+	// A nil key is the same as an empty one
+	value, err := db.Get([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("empty")) {
+		t.Errorf("expected the value of the empty key, got %q", value)
+	}
+
+	// An empty start includes the empty key, an empty end excludes
+	// everything
+	pairs, _, err := db.GetRange([]byte{}, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || len(pairs[0].Key) != 0 {
+		t.Errorf("expected the empty key first, got %v", pairs)
+	}
+	pairs, _, err = db.GetRange(nil, []byte{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 0 {
+		t.Errorf("expected no pairs before the empty key, got %v", pairs)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+
+	// Appending to a missing key stores the suffix
+	err = db.Append([]byte("c"), []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte("a"), []byte("+"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{"a": "1+++", "b": "2", "c": "3"}
+	pairs, _, err := db.GetRange(nil, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(expected) {
+		t.Fatalf("expected %d pairs, got %v", len(expected), pairs)
+	}
+	for _, kv := range pairs {
+		if expected[string(kv.Key)] != string(kv.Value) {
+			t.Errorf("wrong value for key %q: %q", kv.Key, kv.Value)
+		}
+	}
+
+	// With hooks registered they see the whole value
+	var committed []byte
+	db.OnCommit(func(ops []Op) {
+		committed = copyBytes(ops[0].Value)
+	})
+	db.Append([]byte("b"), []byte("+"))
+	if string(committed) != "2+" {
+		t.Errorf("expected the commit hook to see the whole value, got %q", committed)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a"), []byte("hello"))
+	db.Set([]byte("b"), []byte{})
+
+	buf := make([]byte, 0, 16)
+	value, err := db.GetInto([]byte("a"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" || &value[0] != &buf[:1][0] {
+		t.Errorf("expected the value to be read into the buffer, got %q", value)
+	}
+
+	value, err = db.GetInto([]byte("b"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value == nil || len(value) != 0 {
+		t.Errorf("expected an empty value, got %v", value)
+	}
+	value, err = db.GetInto([]byte("c"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Errorf("expected nil for a missing key, got %q", value)
+	}
+
+	key := []byte("a")
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = db.GetInto(key, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("expected GetInto not to allocate, got %f allocs", allocs)
+	}
+
+	var pairs []KV
+	pairs, _, err = db.GetRangeInto(pairs, nil, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || string(pairs[0].Value) != "hello" || pairs[1].Value == nil {
+		t.Fatalf("unexpected pairs: %v", pairs)
+	}
+	first := &pairs[0].Key[0]
+	pairs, _, err = db.GetRangeInto(pairs, []byte("a"), []byte("b"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || &pairs[0].Key[0] != first {
+		t.Errorf("expected the key buffer to be reused, got %v", pairs)
+	}
+}
+
+// benchmarkDB returns a temporary database holding 64 small pairs.
+func benchmarkDB(b *testing.B) *DB {
+	db, err := OpenTemp()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+	return db
+}
+
+func BenchmarkGet(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	key := []byte("key32")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Get(key)
+	}
+}
+
+func BenchmarkGetInto(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	key := []byte("key32")
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = db.GetInto(key, buf)
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	key := []byte("key32")
+	value := []byte("value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Set(key, value)
+	}
+}
+
+func BenchmarkGetRangeInto(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	var pairs []KV
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pairs, _, _ = db.GetRangeInto(pairs, nil, nil, 0, 0)
+	}
+}
+
+func BenchmarkScanFilter(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	prefix := []byte("key")
+	filter := func(key, value []byte) bool { return false }
+	fn := func(key, value []byte) error { return nil }
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.ScanFilter(prefix, filter, fn)
+	}
+}
+
+func TestTraceIDs(t *testing.T) {
+	cleanDB()
+
+	var trace bytes.Buffer
+	db, err := OpenDBWithOptions(DB_PATH, &Options{Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.SetContext(WithTraceID(context.Background(), 7), []byte("hello"), []byte("world"))
+	db.Set([]byte("untraced"), []byte("value"))
+	value, err := db.GetContext(WithTraceID(context.Background(), 9), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("world")) {
+		t.Errorf("wrong value found, expected 'world'")
+	}
+
+	records, err := ReadTrace(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening reads the header and root pages, then each set hits the
+	// root and header pages and the get hits the root page. The markers
+	// aren't returned as records.
+	var traceIDs []uint64
+	for _, record := range records {
+		traceIDs = append(traceIDs, record.TraceID)
+	}
+	if fmt.Sprint(traceIDs) != "[0 0 7 7 0 0 9]" {
+		t.Errorf("unexpected trace IDs %v", traceIDs)
+	}
+}
+
+func TestParanoid(t *testing.T) {
+	cleanDB()
+
+	opts := &Options{Paranoid: true, ParanoidCheckInterval: 2}
+	for i := 0; i < 3; i++ {
+		db, err := OpenDBWithOptions(DB_PATH, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Set([]byte("hello"), []byte("world"))
+		err = db.Check()
+		if err != nil {
+			t.Errorf("unexpected error checking a valid database: %v", err)
+		}
+		db.Close()
+	}
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := db.getHeaderPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opens := header.getParanoidOpens(); opens != 3 {
+		t.Errorf("expected 3 paranoid opens, got %d", opens)
+	}
+	db.Close()
+
+	// Give the root a parent, which only a check notices
+	file, err := os.OpenFile(DB_PATH, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{2, 0, 0, 0}, int64(defaultPageSize)+leafPageParentIndexOffset)
+	file.Close()
+
+	db, err = OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var corruptionErr *CorruptionError
+	_, err = OpenDBWithOptions(DB_PATH, opts)
+	if !errors.As(err, &corruptionErr) || corruptionErr.PageIndex != 1 {
+		t.Errorf("expected a paranoid open to find the corruption, got %v", err)
+	}
+}
+
+func TestCheckParentIndex(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("hello"), []byte("world"))
+	db.Close()
+
+	// Give the root a parent
+	file, err := os.OpenFile(DB_PATH, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{2, 0, 0, 0}, int64(defaultPageSize)+leafPageParentIndexOffset)
+	file.Close()
+
+	db, err = OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var corruptionErr *CorruptionError
+	err = db.Check()
+	if !errors.As(err, &corruptionErr) || corruptionErr.Offset != leafPageParentIndexOffset {
+		t.Errorf("expected a parent index corruption error, got %v", err)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "users/1", "users/2", "users0", "z"} {
+		db.Set([]byte(key), []byte("value"))
+	}
+
+	var deleted []string
+	db.OnCommit(func(ops []Op) {
+		for _, op := range ops {
+			if op.Delete {
+				deleted = append(deleted, string(op.Key))
+			}
+		}
+	})
+
+	count, err := db.DeletePrefix([]byte("users/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || strings.Join(deleted, ",") != "users/1,users/2" {
+		t.Errorf("expected users/1 and users/2 to be deleted, got %d: %v", count, deleted)
+	}
+
+	count, err = db.DeleteRange(nil, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 key deleted, got %d", count)
+	}
+
+	pairs, _, err := db.GetRange(nil, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || string(pairs[0].Key) != "users0" || string(pairs[1].Key) != "z" {
+		t.Errorf("unexpected pairs left: %v", pairs)
+	}
+
+	// The freed space is usable again
+	report, err := db.FragmentationReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUsed := int64(leafPageFirstCellOffset + getLeafNodeCellSize(6, 5) + getLeafNodeCellSize(1, 5))
+	if report.Levels[0].UsedBytes != expectedUsed {
+		t.Errorf("expected %d used bytes, got %d", expectedUsed, report.Levels[0].UsedBytes)
+	}
+}
+
+func TestDeletePrefixHashedKeys(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDBWithOptions(DB_PATH, &Options{KeyCodec: HashedKeyCodec(8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("user/1"), []byte("short"))
+	db.Set([]byte("user/long-key"), []byte("hashed"))
+
+	// Hashed keys can't be decoded, so only the short key matches
+	count, err := db.DeletePrefix([]byte("user/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected only the short key to be deleted, got %d", count)
+	}
+	value, _ := db.Get([]byte("user/long-key"))
+	if string(value) != "hashed" {
+		t.Errorf("expected the hashed key to be kept, got '%s'", string(value))
+	}
+
+	count, err = db.DeletePrefix([]byte("user/long"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected a prefix longer than maxLen to match nothing, got %d", count)
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "b\x00", "c", "d"} {
+		db.Set([]byte(key), []byte("value"))
+	}
+
+	scan := func(r Range) string {
+		var keys []string
+		err := db.ScanRange(r, func(key, value []byte) error {
+			keys = append(keys, fmt.Sprintf("%q", key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+
+	for _, test := range []struct {
+		r        Range
+		expected string
+	}{
+		{Range{}, `"a" "b" "b\x00" "c" "d"`},
+		{Range{Start: []byte("b"), End: []byte("c")}, `"b\x00"`},
+		{Range{Start: []byte("b"), End: []byte("c"), StartInclusive: true}, `"b" "b\x00"`},
+		{Range{Start: []byte("b"), End: []byte("c"), EndInclusive: true}, `"b\x00" "c"`},
+		{Range{Start: []byte("b"), End: []byte("c"), StartInclusive: true, EndInclusive: true}, `"b" "b\x00" "c"`},
+		{Range{End: []byte("b"), EndInclusive: true}, `"a" "b"`},
+	} {
+		if keys := scan(test.r); keys != test.expected {
+			t.Errorf("scanning %+v: expected %s, got %s", test.r, test.expected, keys)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, kv := range goldenCells {
+		db.Set([]byte(kv[0]), []byte(kv[1]))
+	}
+
+	path := DB_PATH + ".export"
+	os.Remove(path)
+	defer os.Remove(path)
+
+	err = db.Export(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Export(path)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected exporting over an existing file to fail, got %v", err)
+	}
+
+	exported, err := OpenDBWithOptions(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exported.Close()
+
+	for _, kv := range goldenCells {
+		value, err := exported.Get([]byte(kv[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value, []byte(kv[1])) {
+			t.Errorf("wrong value for key %q: %q", kv[0], value)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*int64(defaultPageSize) {
+		t.Errorf("expected the header and root pages, got %d bytes", info.Size())
+	}
+}
+
+func TestArchive(t *testing.T) {
+	cleanDB()
+
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	path := DB_PATH + ".archive"
+	defer os.Remove(path)
+
+	var archive bytes.Buffer
+	err = db.WriteArchive(&archive)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Len() >= 2*int(defaultPageSize) {
+		t.Errorf("expected the archive to be compressed, got %d bytes", archive.Len())
+	}
+	err = os.WriteFile(path, archive.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archived, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archived.Close()
+
+	for i := 0; i < 64; i++ {
+		value, err := archived.Get([]byte(fmt.Sprintf("key%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte("value")) {
+			t.Errorf("wrong value for key%02d: %q", i, value)
+		}
+	}
+
+	err = archived.Set([]byte("key"), []byte("value"))
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	// A truncated archive is rejected on open
+	err = os.WriteFile(path, archive.Bytes()[:archive.Len()-1], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenArchive(path)
+	if err == nil {
+		t.Errorf("expected opening a truncated archive to fail")
+	}
+
+	// Block offsets outside of the blocks are rejected on open
+	blockOffsetAt := archive.Len() - archiveFooterSize - 8
+	indexOffset := binary.LittleEndian.Uint64(archive.Bytes()[archive.Len()-archiveFooterSize:])
+	for _, blockOffset := range []uint64{0, archiveHeaderSize - 1, indexOffset, 1 << 63} {
+		data := append([]byte{}, archive.Bytes()...)
+		binary.LittleEndian.PutUint64(data[blockOffsetAt:], blockOffset)
+		_, err := newArchivePageStore(bytes.NewReader(data), int64(len(data)))
+		if err == nil || !strings.Contains(err.Error(), "invalid archive") {
+			t.Errorf("block offset %d: expected an invalid archive error, got %v", blockOffset, err)
+		}
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	data, err := os.ReadFile("testdata/format_v3.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range goldenCells {
+		db.Set([]byte(kv[0]), []byte(kv[1]))
+	}
+	var archive bytes.Buffer
+	err = db.WriteArchive(&archive)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"data.db":      {Data: data},
+		"data.archive": {Data: archive.Bytes()},
+	}
+
+	for _, name := range []string{"data.db", "data.archive"} {
+		db, err := OpenFS(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, kv := range goldenCells {
+			value, err := db.Get([]byte(kv[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value == nil || !bytes.Equal(value, []byte(kv[1])) {
+				t.Errorf("%s: wrong value for key %q: %q", name, kv[0], value)
+			}
+		}
+
+		err = db.Set([]byte("hello"), []byte("world"))
+		if err != ErrReadOnly {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+		db.Close()
+	}
+
+	// The file is read-only, so it is left as it was
+	if !bytes.Equal(fsys["data.db"].Data, data) {
+		t.Errorf("opening the database modified it")
+	}
+}
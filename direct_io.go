@@ -0,0 +1,50 @@
+package tinykv
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment O_DIRECT requires for buffers,
+// offsets and lengths. Pages are always a multiple of it.
+const directIOAlignment = 4096
+
+// openDirect opens path with O_DIRECT where the platform and filesystem
+// support it. It reports whether direct I/O is in effect.
+func openDirect(path string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	if directIOFlag == 0 {
+		file, err := os.OpenFile(path, flag, perm)
+		return file, false, err
+	}
+
+	file, err := os.OpenFile(path, flag|directIOFlag, perm)
+	if errors.Is(err, syscall.EINVAL) {
+		// The filesystem doesn't support O_DIRECT (tmpfs for example)
+		file, err = os.OpenFile(path, flag, perm)
+		return file, false, err
+	}
+	return file, err == nil, err
+}
+
+// alignedBuffer allocates a buffer of the given size whose start is
+// aligned to directIOAlignment. Page sized allocations usually come out
+// aligned already, only the others are padded, so cached pages don't
+// take twice their size.
+func alignedBuffer(size int) []byte {
+	if buf := make([]byte, size); size > 0 && isAligned(buf) {
+		return buf
+	}
+
+	buf := make([]byte, size+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directIOAlignment); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+func isAligned(buf []byte) bool {
+	return uintptr(unsafe.Pointer(&buf[0]))%directIOAlignment == 0
+}
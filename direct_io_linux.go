@@ -0,0 +1,5 @@
+package tinykv
+
+import "syscall"
+
+const directIOFlag = syscall.O_DIRECT
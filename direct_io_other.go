@@ -0,0 +1,5 @@
+//go:build !linux
+
+package tinykv
+
+const directIOFlag = 0
@@ -0,0 +1,110 @@
+package tinykv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// OpenFS opens the database or archive named name in fsys read-only, so
+// a database embedded with go:embed can be read without extracting it.
+// Archives written by WriteArchive are recognized by their magic number.
+func OpenFS(fsys fs.FS, name string) (*DB, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newFSPageStore(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var s pageStore = store
+	magic := make([]byte, len(archiveMagic))
+	if store.fileSize >= int64(len(magic)) {
+		err = store.readAt(magic, 0)
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+	if bytes.Equal(magic, archiveMagic) {
+		archive, err := newArchivePageStore(store, store.fileSize)
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+		s = archive
+	}
+
+	return openDBWithStore(s, &Options{ReadOnly: true})
+}
+
+// fsPageStore reads pages from a file in an fs.FS. Files that can't
+// read at an offset are read into memory.
+type fsPageStore struct {
+	file     fs.File
+	r        io.ReaderAt
+	fileSize int64
+}
+
+func newFSPageStore(file fs.File) (*fsPageStore, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fsPageStore{file: file, fileSize: info.Size()}
+	if r, ok := file.(io.ReaderAt); ok {
+		s.r = r
+	} else {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		s.r = bytes.NewReader(data)
+		s.fileSize = int64(len(data))
+	}
+
+	return s, nil
+}
+
+// ReadAt lets archives be read from the file.
+func (s *fsPageStore) ReadAt(p []byte, offset int64) (int, error) {
+	return s.r.ReadAt(p, offset)
+}
+
+// Close closes the file for archives read from it.
+func (s *fsPageStore) Close() error {
+	return s.file.Close()
+}
+
+func (s *fsPageStore) readAt(data []byte, offset int64) error {
+	n, err := s.r.ReadAt(data, offset)
+	if n == len(data) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("short read at offset %d: read %d of %d bytes", offset, n, len(data))
+	}
+	return err
+}
+
+func (s *fsPageStore) writeAt(data []byte, offset int64) error {
+	return ErrReadOnly
+}
+
+func (s *fsPageStore) size() (int64, error) {
+	return s.fileSize, nil
+}
+
+func (s *fsPageStore) sync(mode SyncMode) error {
+	return nil
+}
+
+func (s *fsPageStore) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,103 @@
+package tinykv
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// goldenCells are the contents of the reference databases in testdata.
+var goldenCells = [][2]string{
+	{"apple", "red"},
+	{"banana", "yellow"},
+	{"", "empty key"},
+	{"empty value", ""},
+	{"\x00\xffbinary", "\x01\x02\x03"},
+	{"zucchini", "green"},
+}
+
+// goldenFiles are reference databases written by each on-disk format
+// version. They must never be regenerated: if current code can't read
+// one of them, the format changed incompatibly.
+var goldenFiles = []string{
+	"testdata/format_v1.db",
+	"testdata/format_v2.db",
+	"testdata/format_v3.db",
+}
+
+func TestGoldenFiles(t *testing.T) {
+	for _, golden := range goldenFiles {
+		t.Run(golden, func(t *testing.T) {
+			data, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Work on a copy, the golden file must stay untouched
+			cleanDB()
+			err = os.WriteFile(DB_PATH, data, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := OpenDB(DB_PATH)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for _, kv := range goldenCells {
+				value, err := db.Get([]byte(kv[0]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value == nil || !bytes.Equal(value, []byte(kv[1])) {
+					t.Errorf("wrong value for key %q: %q", kv[0], value)
+				}
+			}
+
+			report, err := db.FragmentationReport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Levels[0].Cells != len(goldenCells) {
+				t.Errorf("expected %d cells, found %d", len(goldenCells), report.Levels[0].Cells)
+			}
+
+			err = db.Check()
+			if err != nil {
+				t.Errorf("check failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestGoldenFileCurrentFormat checks that the current code still writes
+// exactly the bytes of the newest golden file.
+func TestGoldenFileCurrentFormat(t *testing.T) {
+	golden, err := os.ReadFile(goldenFiles[len(goldenFiles)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanDB()
+	db, err := OpenDB(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range goldenCells {
+		err := db.Set([]byte(kv[0]), []byte(kv[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	written, err := os.ReadFile(DB_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, golden) {
+		t.Errorf("database written by current code differs from %s", goldenFiles[len(goldenFiles)-1])
+	}
+}
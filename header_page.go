@@ -0,0 +1,165 @@
+package tinykv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Header page layout:
+| OFFSET | SIZE | DATA
+|      0 |    1 | page type
+|      1 |    3 | reserved
+|      4 |    4 | magic ("TKV\0")
+|      8 |    4 | format version
+|     12 |    4 | page size
+|     16 |    4 | root page index
+|     20 |    2 | key codec name length
+|     22 |  kcl | key codec name
+|    256 |  192 | key size histogram
+|    448 |  192 | value size histogram
+|    640 |    4 | paranoid opens
+
+Databases written by format version 1 have no header page, their root
+leaf is page 0. Format version 2 has no histograms, the bytes are zero
+so the histograms of those databases start out empty. Paranoid opens
+is zero until the database is opened with Options.Paranoid.
+*/
+
+const (
+	headerPageMagicOffset         = 4
+	headerPageFormatVersionOffset = 8
+	headerPagePageSizeOffset      = 12
+	headerPageRootIndexOffset     = 16
+	headerPageKeyCodecOffset      = 20
+	headerPageKeySizesOffset      = 256
+	headerPageValueSizesOffset    = headerPageKeySizesOffset + sizeHistogramSize
+	headerPageParanoidOpensOffset = headerPageValueSizesOffset + sizeHistogramSize
+
+	currentFormatVersion uint32 = 3
+)
+
+var headerPageMagic = []byte("TKV\x00")
+
+type headerPage struct {
+	pageBase
+}
+
+func newHeaderPage(data []byte) *headerPage {
+	p := &headerPage{
+		pageBase: pageBase{data: data},
+	}
+
+	if p.data == nil {
+		p.data = alignedBuffer(int(defaultPageSize))
+
+		p.data[0] = byte(pageKindHeader)
+		copy(p.data[headerPageMagicOffset:headerPageMagicOffset+4], headerPageMagic)
+		binary.LittleEndian.PutUint32(p.data[headerPageFormatVersionOffset:headerPageFormatVersionOffset+4], currentFormatVersion)
+		binary.LittleEndian.PutUint32(p.data[headerPagePageSizeOffset:headerPagePageSizeOffset+4], defaultPageSize)
+	}
+
+	return p
+}
+
+func (p *headerPage) getFormatVersion() uint32 {
+	return binary.LittleEndian.Uint32(p.data[headerPageFormatVersionOffset : headerPageFormatVersionOffset+4])
+}
+
+func (p *headerPage) getPageSize() uint32 {
+	return binary.LittleEndian.Uint32(p.data[headerPagePageSizeOffset : headerPagePageSizeOffset+4])
+}
+
+func (p *headerPage) getRootIndex() uint32 {
+	return binary.LittleEndian.Uint32(p.data[headerPageRootIndexOffset : headerPageRootIndexOffset+4])
+}
+
+func (p *headerPage) setRootIndex(rootIndex uint32) {
+	binary.LittleEndian.PutUint32(p.data[headerPageRootIndexOffset:headerPageRootIndexOffset+4], rootIndex)
+}
+
+func (p *headerPage) getKeyCodecName() string {
+	nameLen := uint32(binary.LittleEndian.Uint16(p.data[headerPageKeyCodecOffset : headerPageKeyCodecOffset+2]))
+	return string(p.data[headerPageKeyCodecOffset+2 : headerPageKeyCodecOffset+2+nameLen])
+}
+
+func (p *headerPage) setKeyCodecName(name string) error {
+	maxLen := uint32(headerPageKeySizesOffset - headerPageKeyCodecOffset - 2)
+	if uint32(len(name)) > maxLen {
+		return fmt.Errorf("key codec name is too long: %d bytes, at most %d allowed", len(name), maxLen)
+	}
+
+	binary.LittleEndian.PutUint16(p.data[headerPageKeyCodecOffset:headerPageKeyCodecOffset+2], uint16(len(name)))
+	copy(p.data[headerPageKeyCodecOffset+2:], name)
+	return nil
+}
+
+func (p *headerPage) recordWriteSizes(keyLen, valueLen int) {
+	recordSizeInPage(p.data[headerPageKeySizesOffset:headerPageKeySizesOffset+sizeHistogramSize], keyLen)
+	recordSizeInPage(p.data[headerPageValueSizesOffset:headerPageValueSizesOffset+sizeHistogramSize], valueLen)
+}
+
+func (p *headerPage) getParanoidOpens() uint32 {
+	return binary.LittleEndian.Uint32(p.data[headerPageParanoidOpensOffset : headerPageParanoidOpensOffset+4])
+}
+
+func (p *headerPage) setParanoidOpens(opens uint32) {
+	binary.LittleEndian.PutUint32(p.data[headerPageParanoidOpensOffset:headerPageParanoidOpensOffset+4], opens)
+}
+
+func (p *headerPage) getSizeHistograms() (SizeHistogram, SizeHistogram) {
+	return readSizeHistogram(p.data[headerPageKeySizesOffset : headerPageKeySizesOffset+sizeHistogramSize]),
+		readSizeHistogram(p.data[headerPageValueSizesOffset : headerPageValueSizesOffset+sizeHistogramSize])
+}
+
+// checkHeaderPageData verifies a header page loaded from disk before any
+// of its fields are used.
+func checkHeaderPageData(pageIndex uint32, data []byte) error {
+	corrupted := func(offset uint32, expected string, found string) error {
+		return &CorruptionError{
+			PageIndex:   pageIndex,
+			Offset:      offset,
+			ParentIndex: -1,
+			Expected:    expected,
+			Found:       found,
+		}
+	}
+
+	magic := data[headerPageMagicOffset : headerPageMagicOffset+4]
+	if !bytes.Equal(magic, headerPageMagic) {
+		return corrupted(headerPageMagicOffset, fmt.Sprintf("magic %q", headerPageMagic), fmt.Sprintf("%q", magic))
+	}
+
+	nameLen := uint32(binary.LittleEndian.Uint16(data[headerPageKeyCodecOffset : headerPageKeyCodecOffset+2]))
+	if headerPageKeyCodecOffset+2+nameLen > headerPageKeySizesOffset {
+		return corrupted(headerPageKeyCodecOffset, "key codec name to end before the histograms", fmt.Sprintf("length %d", nameLen))
+	}
+
+	return nil
+}
+
+// validateOptions checks that the options a database is opened with are
+// compatible with the ones it was created with.
+func (p *headerPage) validateOptions(opts *Options) error {
+	if version := p.getFormatVersion(); version > currentFormatVersion {
+		return fmt.Errorf("database uses format version %d, this version of tinykv supports up to %d",
+			version, currentFormatVersion)
+	}
+	if pageSize := p.getPageSize(); pageSize != defaultPageSize {
+		return fmt.Errorf("database was created with page size %d, opened with page size %d",
+			pageSize, defaultPageSize)
+	}
+	if created, opened := p.getKeyCodecName(), keyCodecName(opts.KeyCodec); created != opened {
+		return fmt.Errorf("database was created with key codec %s, opened with key codec %s",
+			describeKeyCodec(created), describeKeyCodec(opened))
+	}
+	return nil
+}
+
+func describeKeyCodec(name string) string {
+	if name == "" {
+		return "none"
+	}
+	return fmt.Sprintf("%q", name)
+}
@@ -0,0 +1,86 @@
+package tinykv
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// sizeHistogramBuckets is the number of buckets in a SizeHistogram.
+// Bucket 0 counts empty keys or values, bucket i counts sizes in
+// [2^(i-1), 2^i), and the last bucket also counts everything larger.
+const sizeHistogramBuckets = 24
+
+// SizeHistogram counts sizes in power-of-two buckets.
+type SizeHistogram [sizeHistogramBuckets]uint64
+
+func sizeHistogramBucket(size int) int {
+	bucket := bits.Len(uint(size))
+	if bucket >= sizeHistogramBuckets {
+		bucket = sizeHistogramBuckets - 1
+	}
+	return bucket
+}
+
+// BucketRange returns the smallest and largest size counted by bucket.
+// The largest size of the last bucket is math.MaxInt.
+func (h SizeHistogram) BucketRange(bucket int) (int, int) {
+	if bucket == 0 {
+		return 0, 0
+	}
+	if bucket == sizeHistogramBuckets-1 {
+		return 1 << (bucket - 1), math.MaxInt
+	}
+	return 1 << (bucket - 1), 1<<bucket - 1
+}
+
+// Count is the number of sizes recorded.
+func (h SizeHistogram) Count() uint64 {
+	var count uint64
+	for _, bucketCount := range h {
+		count += bucketCount
+	}
+	return count
+}
+
+// Percentile returns an upper bound for the size below which p percent
+// (0 to 100) of the recorded sizes fall.
+func (h SizeHistogram) Percentile(p float64) int {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(float64(count) * p / 100))
+	var seen uint64
+	for bucket, bucketCount := range h {
+		seen += bucketCount
+		if seen >= target && seen > 0 {
+			_, max := h.BucketRange(bucket)
+			return max
+		}
+	}
+	_, max := h.BucketRange(sizeHistogramBuckets - 1)
+	return max
+}
+
+func (h *SizeHistogram) record(size int) {
+	h[sizeHistogramBucket(size)]++
+}
+
+// Histograms are stored as little-endian uint64 counters
+const sizeHistogramSize = sizeHistogramBuckets * 8
+
+func readSizeHistogram(data []byte) SizeHistogram {
+	var h SizeHistogram
+	for i := range h {
+		h[i] = binary.LittleEndian.Uint64(data[i*8 : i*8+8])
+	}
+	return h
+}
+
+func recordSizeInPage(data []byte, size int) {
+	offset := sizeHistogramBucket(size) * 8
+	count := binary.LittleEndian.Uint64(data[offset : offset+8])
+	binary.LittleEndian.PutUint64(data[offset:offset+8], count+1)
+}
@@ -0,0 +1,48 @@
+package tinykv
+
+// Op is a single write applied to the database.
+type Op struct {
+	Key   []byte
+	Value []byte
+	// Delete is set if the write removed Key, Value is nil then.
+	Delete bool
+}
+
+// OnBeforeSet registers fn to be called before every write. If fn
+// returns an error the write is rejected and the error is returned to
+// the caller. Hooks run while the write latch is held, so they must not
+// call back into the DB.
+func (db *DB) OnBeforeSet(fn func(key, value []byte) error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.beforeSetHooks = append(db.beforeSetHooks, fn)
+}
+
+// OnCommit registers fn to be called with the operations of every
+// successful write. Every Set and UpdateValue currently commits a single
+// operation, deleting a range commits one operation per deleted key.
+// The slices in ops belong to the caller of the write and must not be
+// retained.
+func (db *DB) OnCommit(fn func(ops []Op)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.commitHooks = append(db.commitHooks, fn)
+}
+
+func (db *DB) runBeforeSetHooks(key, value []byte) error {
+	for _, hook := range db.beforeSetHooks {
+		err := hook(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) runCommitHooks(ops []Op) {
+	for _, hook := range db.commitHooks {
+		hook(ops)
+	}
+}
@@ -57,7 +57,7 @@ func newInternalPage(index uint32, data []byte) *internalPage {
 	}
 
 	if p.data == nil {
-		p.data = make([]uint8, defaultPageSize)
+		p.data = alignedBuffer(int(defaultPageSize))
 
 		p.data[0] = uint8(pageKindInternal)
 		p.setNumCells(0)
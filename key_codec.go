@@ -0,0 +1,102 @@
+package tinykv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// KeyCodec transforms keys before they are stored. Every key passed to
+// the DB is encoded with EncodeKey, and keys read back out of the tree
+// are decoded with DecodeKey.
+type KeyCodec interface {
+	EncodeKey(key []byte) []byte
+	// DecodeKey inverts EncodeKey. It returns false if the stored key
+	// can't be inverted, for example because it was hashed.
+	DecodeKey(stored []byte) ([]byte, bool)
+}
+
+// NamedKeyCodec can be implemented by a KeyCodec to identify itself.
+// The name is stored in the database header when the database is
+// created, and opening the database with a codec of a different name
+// fails. Codecs that don't implement it are identified by their type.
+type NamedKeyCodec interface {
+	KeyCodec
+	Name() string
+}
+
+func keyCodecName(codec KeyCodec) string {
+	if codec == nil {
+		return ""
+	}
+	if named, ok := codec.(NamedKeyCodec); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", codec)
+}
+
+type namespaceKeyCodec struct {
+	prefix []byte
+}
+
+// NamespaceKeyCodec prepends prefix to every key.
+func NamespaceKeyCodec(prefix []byte) KeyCodec {
+	return &namespaceKeyCodec{prefix: append([]byte{}, prefix...)}
+}
+
+func (c *namespaceKeyCodec) EncodeKey(key []byte) []byte {
+	stored := make([]byte, 0, len(c.prefix)+len(key))
+	stored = append(stored, c.prefix...)
+	return append(stored, key...)
+}
+
+func (c *namespaceKeyCodec) Name() string {
+	return fmt.Sprintf("namespace(%x)", c.prefix)
+}
+
+func (c *namespaceKeyCodec) DecodeKey(stored []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(stored, c.prefix) {
+		return nil, false
+	}
+	return stored[len(c.prefix):], true
+}
+
+type hashedKeyCodec struct {
+	maxLen int
+}
+
+// HashedKeyCodec replaces keys longer than maxLen bytes with their
+// SHA-256 hash, keeping long keys from taking up page space. Keys are
+// tagged with a leading byte so short keys can still be decoded.
+func HashedKeyCodec(maxLen int) KeyCodec {
+	return &hashedKeyCodec{maxLen: maxLen}
+}
+
+const (
+	hashedKeyPlain  = 0
+	hashedKeyHashed = 1
+)
+
+func (c *hashedKeyCodec) EncodeKey(key []byte) []byte {
+	if len(key) <= c.maxLen {
+		stored := make([]byte, 0, len(key)+1)
+		stored = append(stored, hashedKeyPlain)
+		return append(stored, key...)
+	}
+
+	sum := sha256.Sum256(key)
+	stored := make([]byte, 0, len(sum)+1)
+	stored = append(stored, hashedKeyHashed)
+	return append(stored, sum[:]...)
+}
+
+func (c *hashedKeyCodec) Name() string {
+	return fmt.Sprintf("hashed(%d)", c.maxLen)
+}
+
+func (c *hashedKeyCodec) DecodeKey(stored []byte) ([]byte, bool) {
+	if len(stored) == 0 || stored[0] != hashedKeyPlain {
+		return nil, false
+	}
+	return stored[1:], true
+}
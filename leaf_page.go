@@ -60,7 +60,7 @@ func newLeafPage(data []byte) *leafPage {
 	}
 
 	if p.data == nil {
-		p.data = make([]byte, defaultPageSize)
+		p.data = alignedBuffer(int(defaultPageSize))
 
 		p.data[0] = byte(pageKindLeaf)
 		p.setNumCells(0)
@@ -150,11 +150,24 @@ func (it *leafCellIterator) next() leafCell {
 func (p *leafPage) addCell(key, value []byte) error {
 	requiredSpace := getLeafNodeCellSize(len(key), len(value))
 	freeSpace := p.freeSpace
-	if requiredSpace > p.freeSpace {
+
+	// If the key already exists its cell is replaced, so the space it
+	// occupies counts as free
+	existingCell, found := p.getCell(key)
+	if found {
+		freeSpace += getLeafNodeCellSize(len(existingCell.key), len(existingCell.value))
+	}
+
+	if requiredSpace > freeSpace {
 		// TODO: split current page
 		return fmt.Errorf("not enough space left in page. required: %d, free space: %d", requiredSpace, freeSpace)
 	}
 
+	if found {
+		p.removeCellAt(existingCell)
+	}
+	freeSpace = p.freeSpace
+
 	// Calculate the offset of the new cell
 	offset := uint32(leafPageFirstCellOffset)
 	for iter := p.iter(); iter.hasNext(); {
@@ -193,6 +206,48 @@ func (p *leafPage) addCell(key, value []byte) error {
 	return nil
 }
 
+// appendToCell extends the value of cell with suffix, which must fit in
+// the free space.
+func (p *leafPage) appendToCell(cell leafCell, suffix []byte) {
+	cellEnd := cell.offset + getLeafNodeCellSize(len(cell.key), len(cell.value))
+	usedEnd := uint32(len(p.data)) - p.freeSpace
+	suffixLen := uint32(len(suffix))
+
+	// Shift every cell to the right of this one to make room
+	copy(p.data[cellEnd+suffixLen:], p.data[cellEnd:usedEnd])
+	copy(p.data[cellEnd:cellEnd+suffixLen], suffix)
+
+	valueLenOffset := cell.offset + 4 + uint32(len(cell.key))
+	binary.LittleEndian.PutUint32(p.data[valueLenOffset:valueLenOffset+4], uint32(len(cell.value))+suffixLen)
+
+	p.freeSpace -= suffixLen
+}
+
+func (p *leafPage) removeCellAt(cell leafCell) {
+	cellSize := getLeafNodeCellSize(len(cell.key), len(cell.value))
+	usedEnd := uint32(len(p.data)) - p.freeSpace
+
+	// Shift every cell to the right of the removed one to the left and
+	// clear the bytes that became free
+	copy(p.data[cell.offset:], p.data[cell.offset+cellSize:usedEnd])
+	for i := usedEnd - cellSize; i < usedEnd; i++ {
+		p.data[i] = 0
+	}
+
+	p.freeSpace += cellSize
+	p.setNumCells(p.getNumCells() - 1)
+}
+
+func (p *leafPage) getCell(key []byte) (leafCell, bool) {
+	for iter := p.iter(); iter.hasNext(); {
+		cell := iter.next()
+		if bytes.Equal(key, cell.key) {
+			return cell, true
+		}
+	}
+	return leafCell{}, false
+}
+
 func (p *leafPage) findCell(key []byte) ([]byte, error) {
 	var foundValue []byte = nil
 	for iter := p.iter(); iter.hasNext(); {
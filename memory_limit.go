@@ -0,0 +1,67 @@
+package tinykv
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// defaultMemoryLimitFraction is the share of the available memory the
+// buffer pool may use when Options.MemoryLimit is not set.
+const defaultMemoryLimitFraction = 4
+
+// defaultMemoryLimit sizes the buffer pool from the memory available to
+// the process, taking container limits into account. It returns 0 (no
+// limit) if the available memory can't be determined.
+func defaultMemoryLimit() int64 {
+	available := availableMemory()
+	if available <= 0 {
+		return 0
+	}
+
+	limit := available / defaultMemoryLimitFraction
+	if limit < int64(defaultPageSize) {
+		limit = int64(defaultPageSize)
+	}
+	return limit
+}
+
+// parseCgroupLimit parses memory.max (cgroup v2) or
+// memory.limit_in_bytes (cgroup v1). It returns 0 if there is no limit.
+func parseCgroupLimit(data []byte) int64 {
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0
+	}
+
+	// cgroup v1 reports "no limit" as a huge page-aligned number
+	if limit >= 1<<62 {
+		return 0
+	}
+	return limit
+}
+
+// parseMemTotal returns MemTotal from /proc/meminfo in bytes, or 0 if it
+// is missing.
+func parseMemTotal(data []byte) int64 {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
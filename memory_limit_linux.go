@@ -0,0 +1,29 @@
+package tinykv
+
+import "os"
+
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+func availableMemory() int64 {
+	var available int64
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		available = parseMemTotal(data)
+	}
+
+	for _, path := range cgroupMemoryLimitFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit := parseCgroupLimit(data)
+		if limit > 0 && (available == 0 || limit < available) {
+			available = limit
+		}
+		break
+	}
+
+	return available
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tinykv
+
+func availableMemory() int64 {
+	return 0
+}
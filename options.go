@@ -0,0 +1,74 @@
+package tinykv
+
+import (
+	"io"
+	"time"
+)
+
+// Options configures how a database is opened. A nil *Options is
+// equivalent to the zero value, which uses the defaults.
+type Options struct {
+	// MaxSize is the maximum size in bytes the database file may grow
+	// to. Writes that would need to grow the file past it fail with
+	// ErrDatabaseFull. Zero means no limit.
+	MaxSize int64
+
+	// Trace, if set, receives a binary record for every page lookup, page
+	// read and page write. Records can be decoded with ReadTrace. Writes
+	// to it are not buffered.
+	Trace io.Writer
+
+	// DirectIO opens the database file with O_DIRECT so page reads and
+	// writes bypass the OS page cache. It is ignored on platforms and
+	// filesystems that don't support it.
+	DirectIO bool
+
+	// SyncMode controls how the database file is synced to stable storage
+	// after pages are written. The default is SyncNone.
+	SyncMode SyncMode
+
+	// KeyCodec, if set, transforms every key on its way into the
+	// database. The same codec must be used every time the database is
+	// opened.
+	KeyCodec KeyCodec
+
+	// MemoryLimit caps the bytes of pages cached by the buffer pool. When
+	// loading a page goes over it, the pages loaded longest ago are
+	// written back and evicted. Zero sizes the limit to a quarter of the
+	// memory available to the process, respecting cgroup limits on
+	// Linux. A negative value means no limit.
+	MemoryLimit int64
+
+	// ErrorIfExists makes opening fail with an error matching
+	// os.ErrExist if the database file already exists.
+	ErrorIfExists bool
+
+	// MustExist makes opening fail with an error matching os.ErrNotExist
+	// if the database file doesn't exist, instead of creating it.
+	MustExist bool
+
+	// ReadOnly opens an existing database without write access. Writes
+	// fail with ErrReadOnly and nothing is written back to the file, so
+	// the database can be read while another process has it open for
+	// writing. Only the pages present when it was opened are readable,
+	// and they reflect the writer's state as of its last flush.
+	ReadOnly bool
+
+	// WriteStallThreshold is how long a write may wait on the DB latch,
+	// on evicting pages or on syncing the file before it is reported to
+	// the OnWriteStall hooks and counted in Stats. Zero means 100ms.
+	WriteStallThreshold time.Duration
+
+	// Paranoid checks the pages at the top of the tree as stored on disk
+	// when the database is opened, and every ParanoidCheckInterval opens
+	// checks every page like Check does. It makes opening slower in
+	// exchange for finding corruption early. Opens are counted in the
+	// database file, read-only opens aren't counted and only check the
+	// top of the tree.
+	Paranoid bool
+	// ParanoidCheckInterval is the number of paranoid opens between full
+	// checks, counting the first one. Zero means 16.
+	ParanoidCheckInterval int
+}
+
+var defaultOptions = Options{}
@@ -0,0 +1,200 @@
+package tinykv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// pageStore is the storage the buffer pool reads pages from and writes
+// pages to. Offsets and lengths are always multiples of the page size.
+type pageStore interface {
+	readAt(data []byte, offset int64) error
+	writeAt(data []byte, offset int64) error
+	size() (int64, error)
+	sync(mode SyncMode) error
+	close() error
+}
+
+type filePageStore struct {
+	file     *os.File
+	directIO bool
+}
+
+func openFilePageStore(path string, opts *Options) (*filePageStore, error) {
+	if opts.ErrorIfExists && opts.MustExist {
+		return nil, errors.New("ErrorIfExists and MustExist can't both be set")
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if opts.ErrorIfExists {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+		}
+		// An empty file, like the ones os.CreateTemp makes, is replaced
+		// with a new database. Read-only opens leave it to
+		// openDBWithStore to reject.
+		if info.Size() == 0 && !opts.ReadOnly {
+			err = createDBFile(path, opts, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if opts.MustExist || opts.ReadOnly {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		err = createDBFile(path, opts, false)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	var file *os.File
+	var directIO bool
+	if opts.DirectIO {
+		file, directIO, err = openDirect(path, flag, 0600)
+	} else {
+		file, err = os.OpenFile(path, flag, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &filePageStore{
+		file:     file,
+		directIO: directIO,
+	}, nil
+}
+
+// createDBFile creates a new database at path holding the header page
+// and an empty root page. The pages are written to a temporary file
+// first and then moved into place, so a crash can never leave a
+// half-initialized database behind. With replace, path is an empty file
+// that the database is renamed over.
+func createDBFile(path string, opts *Options, replace bool) error {
+	pages, err := newDBPages(opts)
+	if err != nil {
+		return err
+	}
+	if opts.MaxSize > 0 && opts.MaxSize < int64(len(pages))*int64(defaultPageSize) {
+		return ErrDatabaseFull
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	for _, page := range pages {
+		if err == nil {
+			_, err = tmp.Write(page.getData())
+		}
+	}
+	if err == nil {
+		err = syncFile(tmp, opts.SyncMode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		err = os.Rename(tmpPath, path)
+		if err != nil {
+			return err
+		}
+		return syncDir(dir, opts.SyncMode)
+	}
+
+	// Linking fails if another process created the database in the
+	// meantime, where renaming would silently replace it. Not every
+	// filesystem supports hard links, so fall back to renaming.
+	err = os.Link(tmpPath, path)
+	if errors.Is(err, os.ErrExist) {
+		if opts.ErrorIfExists {
+			return &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+		}
+		return nil
+	}
+	if err != nil {
+		err = os.Rename(tmpPath, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncDir(dir, opts.SyncMode)
+}
+
+func syncDir(dir string, mode SyncMode) error {
+	if mode == SyncNone {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Not every platform supports syncing directories
+	d.Sync()
+	return nil
+}
+
+// readAt and writeAt go through an aligned copy of data when the file
+// was opened with O_DIRECT and data isn't aligned. Page buffers are
+// allocated aligned, so only other buffers take the copy.
+func (s *filePageStore) readAt(data []byte, offset int64) error {
+	if !s.directIO || isAligned(data) {
+		_, err := s.file.ReadAt(data, offset)
+		return err
+	}
+
+	buf := alignedBuffer(len(data))
+	_, err := s.file.ReadAt(buf, offset)
+	copy(data, buf)
+	return err
+}
+
+func (s *filePageStore) writeAt(data []byte, offset int64) error {
+	if !s.directIO || isAligned(data) {
+		_, err := s.file.WriteAt(data, offset)
+		return err
+	}
+
+	buf := alignedBuffer(len(data))
+	copy(buf, data)
+	_, err := s.file.WriteAt(buf, offset)
+	return err
+}
+
+func (s *filePageStore) size() (int64, error) {
+	fileInfo, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (s *filePageStore) sync(mode SyncMode) error {
+	return syncFile(s.file, mode)
+}
+
+func (s *filePageStore) close() error {
+	return s.file.Close()
+}
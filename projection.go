@@ -0,0 +1,103 @@
+package tinykv
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ValueLayout locates fields inside a stored value without decoding the
+// whole value.
+type ValueLayout interface {
+	// Field returns the bytes of field index of value, or false if value
+	// has no such field. The returned slice may point into value. It
+	// returns an error if value doesn't follow the layout.
+	Field(value []byte, index int) ([]byte, bool, error)
+}
+
+type lengthPrefixedLayout struct{}
+
+// LengthPrefixedLayout is the layout produced by EncodeFields: every
+// field is stored as a 4-byte little-endian length followed by its bytes.
+var LengthPrefixedLayout ValueLayout = lengthPrefixedLayout{}
+
+// EncodeFields builds a value in LengthPrefixedLayout.
+func EncodeFields(fields ...[]byte) []byte {
+	size := 0
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+
+	value := make([]byte, 0, size)
+	for _, field := range fields {
+		value = binary.LittleEndian.AppendUint32(value, uint32(len(field)))
+		value = append(value, field...)
+	}
+	return value
+}
+
+func (lengthPrefixedLayout) Field(value []byte, index int) ([]byte, bool, error) {
+	offset := 0
+	for i := 0; ; i++ {
+		if offset == len(value) {
+			return nil, false, nil
+		}
+		if len(value)-offset < 4 {
+			return nil, false, fmt.Errorf("truncated length prefix at offset %d", offset)
+		}
+		// The length is checked before converting it, so it can't
+		// overflow an int
+		fieldLen := binary.LittleEndian.Uint32(value[offset : offset+4])
+		offset += 4
+		if uint64(fieldLen) > uint64(len(value)-offset) {
+			return nil, false, fmt.Errorf("field of %d bytes at offset %d runs past the end of the value", fieldLen, offset)
+		}
+		if i == index {
+			return value[offset : offset+int(fieldLen)], true, nil
+		}
+		offset += int(fieldLen)
+	}
+}
+
+// ScanProject calls fn with the key and the requested fields of the value
+// of every pair whose key starts with prefix, in key order. Only the
+// projected fields are copied out of the page. fields[i] holds the value
+// of field indexes[i], or nil if the value has no such field. A value
+// that doesn't follow layout stops the scan with a CorruptionError. The
+// scan holds the latch, so fn must not call back into the DB.
+func (db *DB) ScanProject(prefix []byte, layout ValueLayout, indexes []int, fn func(key []byte, fields [][]byte) error) error {
+	for _, index := range indexes {
+		if index < 0 {
+			return fmt.Errorf("invalid field index: %d", index)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var fnErr error
+	err := db.scanCells(prefix, prefixEnd(prefix), func(pageIndex uint32, cell leafCell, key []byte) bool {
+		fields := make([][]byte, len(indexes))
+		for i, index := range indexes {
+			field, ok, err := layout.Field(cell.value, index)
+			if err != nil {
+				fnErr = &CorruptionError{
+					PageIndex:   pageIndex,
+					Offset:      cell.offset + 8 + uint32(len(cell.key)),
+					ParentIndex: -1,
+					Expected:    "a value in the projected layout",
+					Found:       err.Error(),
+				}
+				return false
+			}
+			if ok {
+				fields[i] = copyBytes(field)
+			}
+		}
+		fnErr = fn(copyBytes(key), fields)
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
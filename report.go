@@ -0,0 +1,175 @@
+package tinykv
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// LevelStats describes the pages at one level of the tree. Level 0 is
+// the root.
+type LevelStats struct {
+	Level           int
+	Pages           int
+	Cells           int
+	UsedBytes       int64
+	FillFactor      float64
+	AvgCellsPerPage float64
+}
+
+type FragmentationReport struct {
+	Levels []LevelStats
+	// FilePages is the number of pages in the database file.
+	FilePages uint32
+	// ReachablePages is the number of pages reachable from the root.
+	ReachablePages uint32
+	// ReclaimableBytes is the size of the pages in the file that are not
+	// reachable from the root, which rewriting the file would reclaim.
+	ReclaimableBytes int64
+}
+
+// FragmentationReport walks the tree and reports how densely its pages
+// are filled and how much of the file is not used by the tree.
+func (db *DB) FragmentationReport() (*FragmentationReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	filePages, err := db.bufferPool.getPageCount()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FragmentationReport{FilePages: filePages}
+	err = db.collectLevelStats(report, db.rootIndex, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range report.Levels {
+		level := &report.Levels[i]
+		level.FillFactor = float64(level.UsedBytes) / float64(int64(level.Pages)*int64(defaultPageSize))
+		level.AvgCellsPerPage = float64(level.Cells) / float64(level.Pages)
+		report.ReachablePages += uint32(level.Pages)
+	}
+	// The header page, if there is one, is in use but not part of the tree
+	headerPages := uint32(0)
+	if db.rootIndex != 0 {
+		headerPages = 1
+	}
+	report.ReclaimableBytes = int64(filePages-report.ReachablePages-headerPages) * int64(defaultPageSize)
+
+	return report, nil
+}
+
+func (db *DB) collectLevelStats(report *FragmentationReport, pageIndex uint32, level int) error {
+	p, err := db.bufferPool.getPage(pageIndex)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Levels) <= level {
+		report.Levels = append(report.Levels, LevelStats{Level: level})
+	}
+
+	stats := &report.Levels[level]
+	stats.Pages++
+
+	switch p := p.(type) {
+	case *leafPage:
+		stats.Cells += int(p.getNumCells())
+		stats.UsedBytes += int64(defaultPageSize - p.getFreeSpace())
+	case *internalPage:
+		stats.Cells += int(p.getNumCells())
+		stats.UsedBytes += int64(defaultPageSize - p.getFreeSpace())
+
+		for it := p.iter(); it.hasNext(); {
+			cell := it.next()
+			err := db.collectLevelStats(report, cell.leftChildIndex, level+1)
+			if err != nil {
+				return err
+			}
+		}
+		return db.collectLevelStats(report, p.getRightChildIndex(), level+1)
+	}
+
+	return nil
+}
+
+// PrefixStats aggregates the keys sharing a prefix.
+type PrefixStats struct {
+	Prefix     []byte
+	Keys       int
+	KeyBytes   int64
+	ValueBytes int64
+}
+
+// PrefixStats groups the keys by their first depth bytes and returns the
+// groups largest first, by the total size of their keys and values. Keys
+// shorter than depth form a group of their own. depth must be at least
+// 1.
+func (db *DB) PrefixStats(depth int) ([]PrefixStats, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("invalid prefix depth: %d", depth)
+	}
+
+	return db.prefixStats(func(key []byte) []byte {
+		if len(key) > depth {
+			return key[:depth]
+		}
+		return key
+	})
+}
+
+// DelimitedPrefixStats is like PrefixStats, but groups the keys by their
+// first depth segments separated by delimiter. The prefixes include the
+// trailing delimiter, so "users/1" and "users/2" share the depth 1
+// prefix "users/".
+func (db *DB) DelimitedPrefixStats(delimiter byte, depth int) ([]PrefixStats, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("invalid prefix depth: %d", depth)
+	}
+
+	return db.prefixStats(func(key []byte) []byte {
+		end := 0
+		for i := 0; i < depth; i++ {
+			next := bytes.IndexByte(key[end:], delimiter)
+			if next < 0 {
+				return key
+			}
+			end += next + 1
+		}
+		return key[:end]
+	})
+}
+
+func (db *DB) prefixStats(prefixOf func(key []byte) []byte) ([]PrefixStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var stats []PrefixStats
+	statsIndex := make(map[string]int)
+	err := db.scanRange(nil, nil, func(key, value []byte) bool {
+		prefix := prefixOf(key)
+		i, ok := statsIndex[string(prefix)]
+		if !ok {
+			i = len(stats)
+			statsIndex[string(prefix)] = i
+			stats = append(stats, PrefixStats{Prefix: copyBytes(prefix)})
+		}
+
+		stats[i].Keys++
+		stats[i].KeyBytes += int64(len(key))
+		stats[i].ValueBytes += int64(len(value))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are scanned in order, so ties stay in key order
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].KeyBytes+stats[i].ValueBytes > stats[j].KeyBytes+stats[j].ValueBytes
+	})
+
+	return stats, nil
+}
@@ -0,0 +1,231 @@
+package tinykv
+
+import "bytes"
+
+// KV is a key/value pair returned by range reads.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// GetRange returns the pairs with keys in [start, end) in key order. A
+// nil start or end leaves that side unbounded, while an empty one is a
+// bound at the empty key, the smallest key. At most limit pairs are
+// returned, and pairs stop being added once their total size reaches
+// maxBytes, a limit <= 0 or maxBytes <= 0 disables that bound. At least
+// one pair is returned if the range isn't empty, so callers always make
+// progress.
+//
+// next is the key to pass as start to continue reading the range, or nil
+// if the end of the range was reached.
+//
+// With a KeyCodec, stored keys that can't be decoded are skipped.
+func (db *DB) GetRange(start, end []byte, limit int, maxBytes int) ([]KV, []byte, error) {
+	return db.GetRangeInto(nil, start, end, limit, maxBytes)
+}
+
+// GetRangeInto is like GetRange, but reuses the memory of dst: the pairs
+// are stored in dst[:0], and the key and value buffers of the pairs
+// already in its capacity are reused when they are large enough. Reading
+// a range in a loop with the previous result as dst doesn't allocate
+// once the buffers have grown, but overwrites the previous pairs.
+func (db *DB) GetRangeInto(dst []KV, start, end []byte, limit int, maxBytes int) ([]KV, []byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pairs := dst[:0]
+	var next []byte
+	totalBytes := 0
+
+	err := db.scanRange(start, end, func(key, value []byte) bool {
+		full := (limit > 0 && len(pairs) >= limit) ||
+			(maxBytes > 0 && len(pairs) > 0 && totalBytes+len(key)+len(value) > maxBytes)
+		if full {
+			next = copyBytes(key)
+			return false
+		}
+
+		if len(pairs) < cap(pairs) {
+			pairs = pairs[:len(pairs)+1]
+		} else {
+			pairs = append(pairs, KV{})
+		}
+		kv := &pairs[len(pairs)-1]
+		kv.Key = appendBytes(kv.Key, key)
+		kv.Value = appendBytes(kv.Value, value)
+		totalBytes += len(key) + len(value)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pairs, next, nil
+}
+
+// ScanFilter calls fn with every pair whose key starts with prefix and
+// for which filter returns true, in key order. filter sees the key and
+// value in place inside the page and must not retain or modify them,
+// only pairs that pass it are copied out for fn. A nil filter passes
+// every pair. If fn returns an error the scan stops and returns it. The
+// scan holds the latch, so filter and fn must not call back into the DB.
+func (db *DB) ScanFilter(prefix []byte, filter func(key, value []byte) bool, fn func(key, value []byte) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var fnErr error
+	err := db.scanRange(prefix, prefixEnd(prefix), func(key, value []byte) bool {
+		if filter != nil && !filter(key, value) {
+			return true
+		}
+		fnErr = fn(copyBytes(key), copyBytes(value))
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Range is a range of keys. A nil Start or End leaves that side
+// unbounded, the inclusive flags then have no effect.
+type Range struct {
+	Start, End     []byte
+	StartInclusive bool
+	EndInclusive   bool
+}
+
+// HalfOpen returns the bounds [start, end) of the keys in r, in the
+// form GetRange takes them.
+func (r Range) HalfOpen() ([]byte, []byte) {
+	// The smallest key after k is k followed by a zero byte
+	start := r.Start
+	if start != nil && !r.StartInclusive {
+		start = append(copyBytes(start), 0)
+	}
+	end := r.End
+	if end != nil && r.EndInclusive {
+		end = append(copyBytes(end), 0)
+	}
+	return start, end
+}
+
+// ScanRange calls fn with every pair with a key in r, in key order. If
+// fn returns an error the scan stops and returns it. The scan holds the
+// latch, so fn must not call back into the DB.
+func (db *DB) ScanRange(r Range, fn func(key, value []byte) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	start, end := r.HalfOpen()
+
+	var fnErr error
+	err := db.scanRange(start, end, func(key, value []byte) bool {
+		fnErr = fn(copyBytes(key), copyBytes(value))
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// prefixEnd returns the smallest key greater than every key starting
+// with prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// scanRange calls fn with the decoded key and value of every cell with a
+// key in [start, end), in key order, until fn returns false. The slices
+// passed to fn point into page data and are only valid during the call.
+func (db *DB) scanRange(start, end []byte, fn func(key, value []byte) bool) error {
+	return db.scanCells(start, end, func(pageIndex uint32, cell leafCell, key []byte) bool {
+		return fn(key, cell.value)
+	})
+}
+
+// scanCells is like scanRange, but passes fn the cell along with its
+// decoded key and the index of its page.
+func (db *DB) scanCells(start, end []byte, fn func(pageIndex uint32, cell leafCell, key []byte) bool) error {
+	if start != nil {
+		start = db.encodeKey(start)
+	}
+	if end != nil {
+		end = db.encodeKey(end)
+	}
+
+	_, err := db.walkCells(db.rootIndex, func(pageIndex uint32, cell leafCell) (bool, error) {
+		if start != nil && bytes.Compare(cell.key, start) < 0 {
+			return true, nil
+		}
+		if end != nil && bytes.Compare(cell.key, end) >= 0 {
+			return false, nil
+		}
+
+		key := cell.key
+		if db.keyCodec != nil {
+			var ok bool
+			key, ok = db.keyCodec.DecodeKey(cell.key)
+			if !ok {
+				return true, nil
+			}
+		}
+
+		return fn(pageIndex, cell, key), nil
+	})
+	return err
+}
+
+// walkCells visits the leaf cells under pageIndex in key order until fn
+// returns false, passing fn the index of each cell's page. It reports
+// whether the walk should continue.
+func (db *DB) walkCells(pageIndex uint32, fn func(pageIndex uint32, cell leafCell) (bool, error)) (bool, error) {
+	p, err := db.bufferPool.getPage(pageIndex)
+	if err != nil {
+		return false, err
+	}
+
+	switch p := p.(type) {
+	case *leafPage:
+		for iter := p.iter(); iter.hasNext(); {
+			more, err := fn(pageIndex, iter.next())
+			if err != nil || !more {
+				return false, err
+			}
+		}
+	case *internalPage:
+		for iter := p.iter(); iter.hasNext(); {
+			more, err := db.walkCells(iter.next().leftChildIndex, fn)
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		return db.walkCells(p.getRightChildIndex(), fn)
+	}
+
+	return true, nil
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// appendBytes copies src into the memory of dst, growing it if needed.
+// The result is never nil, so empty values stay distinguishable from
+// missing ones.
+func appendBytes(dst, src []byte) []byte {
+	if dst == nil {
+		return copyBytes(src)
+	}
+	return append(dst[:0], src...)
+}
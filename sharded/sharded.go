@@ -0,0 +1,200 @@
+// Package sharded spreads keys across several tinykv databases.
+package sharded
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+
+	"github.com/felipeagc/tinykv"
+)
+
+// DB routes every key to one of a fixed set of tinykv databases using
+// jump consistent hashing, so adding a shard at the end only moves about
+// 1/n of the keys.
+type DB struct {
+	shards []*tinykv.DB
+}
+
+// Open opens one database per path. The order of paths determines which
+// shard a key maps to and must not change between runs.
+func Open(paths []string) (*DB, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no shard paths given")
+	}
+
+	db := &DB{}
+	for _, path := range paths {
+		shard, err := tinykv.OpenDB(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.shards = append(db.shards, shard)
+	}
+
+	return db, nil
+}
+
+func (db *DB) Close() {
+	for _, shard := range db.shards {
+		shard.Close()
+	}
+	db.shards = nil
+}
+
+func (db *DB) Set(key, value []byte) error {
+	return db.shardFor(key).Set(key, value)
+}
+
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.shardFor(key).Get(key)
+}
+
+func (db *DB) UpdateValue(key []byte, fn func(old []byte) ([]byte, error)) error {
+	return db.shardFor(key).UpdateValue(key, fn)
+}
+
+// DeletePrefix removes the keys starting with prefix from every shard
+// and returns how many were removed. Shards are cleared one after the
+// other, so if one fails the earlier ones stay cleared.
+func (db *DB) DeletePrefix(prefix []byte) (int, error) {
+	total := 0
+	for _, shard := range db.shards {
+		n, err := shard.DeletePrefix(prefix)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// GetRange is like tinykv.DB.GetRange over the keys of all shards,
+// merged in key order. Shards are read in batches without holding their
+// latches in between, so writes made during a long scan may or may not
+// be seen.
+func (db *DB) GetRange(start, end []byte, limit int, maxBytes int) ([]tinykv.KV, []byte, error) {
+	var pairs []tinykv.KV
+	var next []byte
+	totalBytes := 0
+
+	err := db.merge(start, end, func(kv tinykv.KV) bool {
+		full := (limit > 0 && len(pairs) >= limit) ||
+			(maxBytes > 0 && len(pairs) > 0 && totalBytes+len(kv.Key)+len(kv.Value) > maxBytes)
+		if full {
+			next = kv.Key
+			return false
+		}
+
+		pairs = append(pairs, kv)
+		totalBytes += len(kv.Key) + len(kv.Value)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pairs, next, nil
+}
+
+// ScanRange calls fn with every pair with a key in r across all shards,
+// in key order. If fn returns an error the scan stops and returns it.
+// Like GetRange, the scan isn't a consistent snapshot of the shards, but
+// fn may call back into the DB.
+func (db *DB) ScanRange(r tinykv.Range, fn func(key, value []byte) error) error {
+	start, end := r.HalfOpen()
+
+	var fnErr error
+	err := db.merge(start, end, func(kv tinykv.KV) bool {
+		fnErr = fn(kv.Key, kv.Value)
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// mergeBatchSize is how many pairs are read from a shard at a time while
+// merging.
+const mergeBatchSize = 64
+
+// cursor reads the keys of a shard in [start, end) in batches.
+type cursor struct {
+	shard *tinykv.DB
+	pairs []tinykv.KV
+	next  []byte
+	end   []byte
+	done  bool
+}
+
+// fill reads the next batch once the current one is consumed.
+func (c *cursor) fill() error {
+	if len(c.pairs) > 0 || c.done {
+		return nil
+	}
+
+	pairs, next, err := c.shard.GetRange(c.next, c.end, mergeBatchSize, 0)
+	if err != nil {
+		return err
+	}
+	c.pairs = pairs
+	c.next = next
+	c.done = next == nil
+	return nil
+}
+
+// merge calls fn with the pairs of every shard with a key in [start,
+// end), in key order, until fn returns false. A key lives in a single
+// shard, so there are no duplicates to resolve. There are few shards, so
+// the smallest head is found with a linear search instead of a heap.
+func (db *DB) merge(start, end []byte, fn func(kv tinykv.KV) bool) error {
+	cursors := make([]*cursor, len(db.shards))
+	for i, shard := range db.shards {
+		cursors[i] = &cursor{shard: shard, next: start, end: end}
+	}
+
+	for {
+		var min *cursor
+		for _, c := range cursors {
+			err := c.fill()
+			if err != nil {
+				return err
+			}
+			if len(c.pairs) == 0 {
+				continue
+			}
+			if min == nil || bytes.Compare(c.pairs[0].Key, min.pairs[0].Key) < 0 {
+				min = c
+			}
+		}
+		if min == nil {
+			return nil
+		}
+
+		kv := min.pairs[0]
+		min.pairs = min.pairs[1:]
+		if !fn(kv) {
+			return nil
+		}
+	}
+}
+
+func (db *DB) shardFor(key []byte) *tinykv.DB {
+	h := fnv.New64a()
+	h.Write(key)
+	return db.shards[jumpHash(h.Sum64(), len(db.shards))]
+}
+
+// jumpHash implements "A Fast, Minimal Memory, Consistent Hash Algorithm"
+// by Lamping and Veach.
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,149 @@
+package sharded
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/felipeagc/tinykv"
+)
+
+func TestSharded(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tinykv-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for i := 0; i < 4; i++ {
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("shard%d.db", i)))
+	}
+
+	db, err := Open(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		err := db.Set(key, []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.Close()
+
+	db, err = Open(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte(fmt.Sprintf("value%d", i))) {
+			t.Errorf("wrong value found for key '%s'", string(key))
+		}
+	}
+}
+
+func TestJumpHashStability(t *testing.T) {
+	moved := 0
+	for key := uint64(0); key < 10000; key++ {
+		if jumpHash(key, 10) != jumpHash(key, 11) {
+			moved++
+		}
+	}
+
+	// Going from 10 to 11 buckets should move roughly 1/11 of the keys
+	if moved > 1500 {
+		t.Errorf("too many keys moved when adding a bucket: %d", moved)
+	}
+}
+
+func TestShardedScans(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tinykv-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for i := 0; i < 4; i++ {
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("shard%d.db", i)))
+	}
+
+	db, err := Open(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// More keys than a merge batch, so shards are read several times
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("a%03d", i))
+		err := db.Set(key, []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Set([]byte(fmt.Sprintf("b%03d", i)), nil)
+	}
+
+	// Reading the range in pages returns every key once, in order
+	var keys []string
+	start := []byte("a")
+	for start != nil {
+		pairs, next, err := db.GetRange(start, []byte("b"), 70, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range pairs {
+			keys = append(keys, string(kv.Key))
+		}
+		start = next
+	}
+	if len(keys) != 300 {
+		t.Fatalf("expected 300 keys, got %d", len(keys))
+	}
+	for i, key := range keys {
+		if key != fmt.Sprintf("a%03d", i) {
+			t.Fatalf("expected key a%03d at %d, got %s", i, i, key)
+		}
+	}
+
+	keys = nil
+	r := tinykv.Range{Start: []byte("a100"), End: []byte("a105"), EndInclusive: true}
+	err = db.ScanRange(r, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[a101 a102 a103 a104 a105]" {
+		t.Errorf("unexpected keys scanned: %v", keys)
+	}
+
+	n, err := db.DeletePrefix([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 300 {
+		t.Errorf("expected 300 keys removed, got %d", n)
+	}
+	pairs, _, err := db.GetRange([]byte("b"), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 0 {
+		t.Errorf("expected no keys left with the prefix, got %d", len(pairs))
+	}
+}
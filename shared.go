@@ -0,0 +1,85 @@
+package tinykv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// Databases opened by path are shared within the process: opening a path
+// that is already open returns a new handle to the same database instead
+// of a second buffer pool working on the same file. Handles are reference
+// counted and the database is only closed by the last Close.
+var (
+	openDBsMu sync.Mutex
+	openDBs   = make(map[string]*sharedDB)
+)
+
+// sharedDBKey identifies the file at path regardless of how the path is
+// spelled.
+func sharedDBKey(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// checkShareable verifies that opts can be served by an already open
+// database. Options that only affect how the file is accessed, like
+// DirectIO, MustExist and WriteStallThreshold, are ignored, the ones the
+// database was first opened with stay in effect. The others must match,
+// except that MaxSize and SyncMode don't matter to read-only handles,
+// which never write. A read-only handle can share a writable database,
+// but a database opened read-only can't be written through a new handle.
+func (db *sharedDB) checkShareable(opts *Options) error {
+	if opts.ErrorIfExists {
+		return &os.PathError{Op: "open", Path: db.path, Err: os.ErrExist}
+	}
+	if db.readOnly && !opts.ReadOnly {
+		return errors.New("database is already open read-only")
+	}
+	if opened, requested := keyCodecName(db.keyCodec), keyCodecName(opts.KeyCodec); opened != requested {
+		return fmt.Errorf("database is already open with key codec %s, opened with key codec %s",
+			describeKeyCodec(opened), describeKeyCodec(requested))
+	}
+
+	mismatch := func(option string, opened, requested interface{}) error {
+		return fmt.Errorf("database is already open with %s %v, opened with %s %v",
+			option, opened, option, requested)
+	}
+	if !opts.ReadOnly && opts.MaxSize != db.opts.MaxSize {
+		return mismatch("MaxSize", db.opts.MaxSize, opts.MaxSize)
+	}
+	if !opts.ReadOnly && opts.SyncMode != db.opts.SyncMode {
+		return mismatch("SyncMode", db.opts.SyncMode, opts.SyncMode)
+	}
+	if opts.MemoryLimit != db.opts.MemoryLimit {
+		return mismatch("MemoryLimit", db.opts.MemoryLimit, opts.MemoryLimit)
+	}
+	if opts.Paranoid != db.opts.Paranoid {
+		return mismatch("Paranoid", db.opts.Paranoid, opts.Paranoid)
+	}
+	if !sameWriter(opts.Trace, db.opts.Trace) {
+		return errors.New("database is already open with a different Trace writer")
+	}
+	return nil
+}
+
+// sameWriter reports whether a and b are the same writer. Writers of
+// types that can't be compared are never the same, instead of making
+// the comparison panic.
+func sameWriter(a, b io.Writer) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
@@ -0,0 +1,95 @@
+package tinykv
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultWriteStallThreshold is used when Options.WriteStallThreshold is
+// zero.
+const defaultWriteStallThreshold = 100 * time.Millisecond
+
+// StallCause is what a stalled write was waiting on.
+type StallCause uint8
+
+const (
+	// StallLatch is time spent waiting for other operations to release
+	// the DB latch.
+	StallLatch StallCause = iota
+	// StallEviction is time spent writing back pages evicted to stay
+	// under the memory limit.
+	StallEviction
+	// StallSync is time spent syncing the file after it grew.
+	StallSync
+)
+
+func (c StallCause) String() string {
+	switch c {
+	case StallLatch:
+		return "latch"
+	case StallEviction:
+		return "eviction"
+	case StallSync:
+		return "sync"
+	default:
+		return fmt.Sprintf("StallCause(%d)", uint8(c))
+	}
+}
+
+// WriteStall describes a write that waited longer than the write stall
+// threshold on one cause.
+type WriteStall struct {
+	Cause    StallCause
+	Duration time.Duration
+	// TraceID is the trace ID the write was run with, see WithTraceID.
+	TraceID uint64
+}
+
+// OnWriteStall registers fn to be called whenever a write waits longer
+// than Options.WriteStallThreshold on the DB latch, on evicting pages or
+// on syncing the file. A write that waits on several of them reports
+// each one separately. Hooks run while the write latch is held, so they
+// must not call back into the DB.
+func (db *DB) OnWriteStall(fn func(stall WriteStall)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.writeStallHooks = append(db.writeStallHooks, fn)
+}
+
+// lockForWrite acquires the DB latch for a write run with traceID,
+// reporting a stall if it took too long.
+func (db *DB) lockForWrite(traceID uint64) {
+	start := time.Now()
+	db.mu.Lock()
+	db.beginTrace(traceID)
+	db.checkWriteStall(StallLatch, time.Since(start))
+}
+
+// stallTimes returns the time the buffer pool has spent on each cause
+// that can stall a write.
+func (db *DB) stallTimes() (eviction, sync time.Duration) {
+	return db.bufferPool.evictionTime, db.bufferPool.syncTime
+}
+
+// checkBufferPoolStalls reports the time spent evicting and syncing
+// since stallTimes returned evictionTime and syncTime.
+func (db *DB) checkBufferPoolStalls(evictionTime, syncTime time.Duration) {
+	newEvictionTime, newSyncTime := db.stallTimes()
+	db.checkWriteStall(StallEviction, newEvictionTime-evictionTime)
+	db.checkWriteStall(StallSync, newSyncTime-syncTime)
+}
+
+func (db *DB) checkWriteStall(cause StallCause, waited time.Duration) {
+	if waited <= db.writeStallThreshold {
+		return
+	}
+
+	db.stats.WriteStalls++
+	db.stats.WriteStallTime += waited
+
+	stall := WriteStall{Cause: cause, Duration: waited, TraceID: db.traceID}
+	for _, hook := range db.writeStallHooks {
+		hook(stall)
+	}
+}
@@ -0,0 +1,110 @@
+package tinykv
+
+import (
+	"time"
+	"unsafe"
+)
+
+// Stats holds cumulative counters since the database was opened, and
+// histograms covering the database's whole lifetime.
+type Stats struct {
+	// Commits is the number of successful writes.
+	Commits uint64
+	// UserBytesWritten is the total size of the keys and values written.
+	UserBytesWritten uint64
+	// DiskBytesWritten is the total size of the pages written to disk.
+	DiskBytesWritten uint64
+	// WriteStalls is the number of times a write waited longer than
+	// Options.WriteStallThreshold, and WriteStallTime the total time
+	// those stalls took. See OnWriteStall.
+	WriteStalls    uint64
+	WriteStallTime time.Duration
+
+	// KeySizes and ValueSizes count the sizes of the keys and values of
+	// every write. They are stored in the header page and persist across
+	// opens, except for format 1 databases which have no header page.
+	KeySizes   SizeHistogram
+	ValueSizes SizeHistogram
+}
+
+// WriteAmplification is the number of bytes written to disk for every
+// byte of user data written. Pages are written back when they are
+// flushed rather than on every commit, so batching many writes between
+// flushes lowers it.
+func (s *Stats) WriteAmplification() float64 {
+	if s.UserBytesWritten == 0 {
+		return 0
+	}
+	return float64(s.DiskBytesWritten) / float64(s.UserBytesWritten)
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stats := db.stats
+	stats.DiskBytesWritten = db.bufferPool.bytesWritten
+
+	if db.rootIndex != 0 {
+		header, err := db.getHeaderPage()
+		if err == nil {
+			stats.KeySizes, stats.ValueSizes = header.getSizeHistograms()
+		}
+	}
+
+	return stats
+}
+
+// recordWriteSizes adds a write to the size histograms.
+func (db *DB) recordWriteSizes(keyLen, valueLen int) error {
+	if db.rootIndex == 0 {
+		// No header page to keep them in
+		db.stats.KeySizes.record(keyLen)
+		db.stats.ValueSizes.record(valueLen)
+		return nil
+	}
+
+	header, err := db.getHeaderPage()
+	if err != nil {
+		return err
+	}
+	header.recordWriteSizes(keyLen, valueLen)
+	return nil
+}
+
+// MemoryUsage is an estimate of the memory held by the database.
+type MemoryUsage struct {
+	// CachedPages is the number of pages held by the buffer pool.
+	CachedPages int
+	// BufferPoolBytes is the size of the cached pages.
+	BufferPoolBytes int64
+	// PageTableBytes is the size of the buffer pool's page table, which
+	// has an entry for every page in the file.
+	PageTableBytes int64
+	// Total is the sum of all of the above.
+	Total int64
+}
+
+func (db *DB) MemoryUsage() MemoryUsage {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bp := db.bufferPool
+	usage := MemoryUsage{
+		CachedPages:     len(bp.loaded),
+		BufferPoolBytes: bp.cachedBytes(),
+		PageTableBytes:  int64(cap(bp.pages))*int64(unsafe.Sizeof(page(nil))) + int64(cap(bp.loaded))*4,
+	}
+	usage.Total = usage.BufferPoolBytes + usage.PageTableBytes
+
+	return usage
+}
+
+// DropCaches writes back every cached page and evicts it, releasing the
+// memory held by the buffer pool until the pages are needed again.
+func (db *DB) DropCaches() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.bufferPool.evictAll()
+}
@@ -0,0 +1,41 @@
+package tinykv
+
+import (
+	"fmt"
+	"os"
+)
+
+type SyncMode uint8
+
+const (
+	// SyncNone never syncs the database file and leaves flushing to the
+	// OS. Data written before a crash of the machine may be lost.
+	SyncNone SyncMode = iota
+	// SyncData syncs file data but not necessarily metadata that isn't
+	// needed to read it back, using fdatasync on Linux.
+	SyncData
+	// SyncFull syncs file data and metadata. On macOS this uses
+	// F_FULLFSYNC, which also flushes the drive's write cache.
+	SyncFull
+)
+
+func (mode SyncMode) validate() error {
+	if mode > SyncFull {
+		return fmt.Errorf("invalid sync mode %d", mode)
+	}
+	return nil
+}
+
+func syncFile(file *os.File, mode SyncMode) error {
+	switch mode {
+	case SyncNone:
+		return nil
+	case SyncData:
+		return fdatasync(file)
+	case SyncFull:
+		return fullfsync(file)
+	default:
+		// Unreachable, the mode is validated when opening
+		return mode.validate()
+	}
+}
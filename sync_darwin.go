@@ -0,0 +1,20 @@
+package tinykv
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync uses a plain fsync, as (*os.File).Sync issues F_FULLFSYNC
+// on darwin, which is only wanted for SyncFull.
+func fdatasync(file *os.File) error {
+	return syscall.Fsync(int(file.Fd()))
+}
+
+func fullfsync(file *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_FULLFSYNC, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
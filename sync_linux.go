@@ -0,0 +1,14 @@
+package tinykv
+
+import (
+	"os"
+	"syscall"
+)
+
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
+
+func fullfsync(file *os.File) error {
+	return file.Sync()
+}
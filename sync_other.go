@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package tinykv
+
+import "os"
+
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
+
+func fullfsync(file *os.File) error {
+	return file.Sync()
+}
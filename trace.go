@@ -0,0 +1,236 @@
+package tinykv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+/*
+Trace record layout:
+| OFFSET | SIZE | DATA
+|      0 |    1 | op
+|      1 |    1 | page kind
+|      2 |    2 | reserved
+|      4 |    4 | page index
+|      8 |    8 | duration in nanoseconds
+
+Operations run with a trace ID are bracketed by begin and end records,
+which store the trace ID in place of the duration. ReadTrace attaches
+the ID to the records in between.
+*/
+
+const traceRecordSize = 16
+
+type TraceOp uint8
+
+const (
+	// TraceOpHit is a page lookup served from the buffer pool.
+	TraceOpHit TraceOp = iota + 1
+	// TraceOpRead is a page loaded from disk.
+	TraceOpRead
+	// TraceOpWrite is a page written to disk.
+	TraceOpWrite
+
+	traceOpBegin
+	traceOpEnd
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceOpHit:
+		return "hit"
+	case TraceOpRead:
+		return "read"
+	case TraceOpWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+type TraceRecord struct {
+	Op        TraceOp
+	PageKind  uint8
+	PageIndex uint32
+	Duration  time.Duration
+	// TraceID is the trace ID of the operation that caused the record,
+	// or 0 if it was run without one.
+	TraceID uint64
+}
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context carrying id, which operations run with
+// the context attach to their trace records and write stalls. Zero
+// means no trace ID.
+func WithTraceID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceIDFromContext returns the trace ID carried by ctx, or 0.
+func TraceIDFromContext(ctx context.Context) uint64 {
+	id, _ := ctx.Value(traceIDKey{}).(uint64)
+	return id
+}
+
+type pageTracer struct {
+	w   io.Writer
+	buf [traceRecordSize]byte
+	// accesses counts lookups per page, used to draw heat maps
+	accesses map[uint32]int
+}
+
+func newPageTracer(w io.Writer) *pageTracer {
+	return &pageTracer{
+		w:        w,
+		accesses: make(map[uint32]int),
+	}
+}
+
+func (t *pageTracer) record(op TraceOp, p page, pageIndex uint32, start time.Time) {
+	if t == nil {
+		return
+	}
+
+	var kind pageKind
+	if p != nil {
+		kind = p.getKind()
+	}
+
+	if op == TraceOpHit || op == TraceOpRead {
+		t.accesses[pageIndex]++
+	}
+
+	t.buf[0] = uint8(op)
+	t.buf[1] = uint8(kind)
+	binary.LittleEndian.PutUint32(t.buf[4:8], pageIndex)
+	binary.LittleEndian.PutUint64(t.buf[8:16], uint64(time.Since(start)))
+
+	// Tracing is a debugging aid, a failing trace writer must not fail
+	// the operation being traced
+	t.w.Write(t.buf[:])
+}
+
+// mark writes the record starting or ending an operation with a trace
+// ID.
+func (t *pageTracer) mark(op TraceOp, traceID uint64) {
+	if t == nil {
+		return
+	}
+
+	t.buf = [traceRecordSize]byte{}
+	t.buf[0] = uint8(op)
+	binary.LittleEndian.PutUint64(t.buf[8:16], traceID)
+	t.w.Write(t.buf[:])
+}
+
+// ReadTrace decodes every record written to Options.Trace.
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+	var traceID uint64
+	buf := make([]byte, traceRecordSize)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return records, errors.New("trace ends with a truncated record")
+		}
+		if err != nil {
+			return records, err
+		}
+
+		switch TraceOp(buf[0]) {
+		case traceOpBegin:
+			traceID = binary.LittleEndian.Uint64(buf[8:16])
+			continue
+		case traceOpEnd:
+			traceID = 0
+			continue
+		}
+
+		records = append(records, TraceRecord{
+			Op:        TraceOp(buf[0]),
+			PageKind:  buf[1],
+			PageIndex: binary.LittleEndian.Uint32(buf[4:8]),
+			Duration:  time.Duration(binary.LittleEndian.Uint64(buf[8:16])),
+			TraceID:   traceID,
+		})
+	}
+}
+
+type PageTraceStats struct {
+	PageIndex uint32
+	Hits      int
+	Reads     int
+	Writes    int
+	IOTime    time.Duration
+}
+
+// Accesses is the number of times the page was looked up.
+func (s *PageTraceStats) Accesses() int {
+	return s.Hits + s.Reads
+}
+
+type TraceReport struct {
+	Hits   int
+	Reads  int
+	Writes int
+	// Pages is sorted by number of accesses, hottest page first.
+	Pages []PageTraceStats
+}
+
+// ReadAmplification is the average number of pages read from disk per
+// page lookup.
+func (r *TraceReport) ReadAmplification() float64 {
+	if r.Hits+r.Reads == 0 {
+		return 0
+	}
+	return float64(r.Reads) / float64(r.Hits+r.Reads)
+}
+
+// SummarizeTrace aggregates trace records per page.
+func SummarizeTrace(records []TraceRecord) *TraceReport {
+	report := &TraceReport{}
+	pages := make(map[uint32]*PageTraceStats)
+
+	for _, record := range records {
+		stats, ok := pages[record.PageIndex]
+		if !ok {
+			stats = &PageTraceStats{PageIndex: record.PageIndex}
+			pages[record.PageIndex] = stats
+		}
+
+		switch record.Op {
+		case TraceOpHit:
+			report.Hits++
+			stats.Hits++
+		case TraceOpRead:
+			report.Reads++
+			stats.Reads++
+			stats.IOTime += record.Duration
+		case TraceOpWrite:
+			report.Writes++
+			stats.Writes++
+			stats.IOTime += record.Duration
+		}
+	}
+
+	for _, stats := range pages {
+		report.Pages = append(report.Pages, *stats)
+	}
+	sort.Slice(report.Pages, func(i, j int) bool {
+		a, b := &report.Pages[i], &report.Pages[j]
+		if a.Accesses() != b.Accesses() {
+			return a.Accesses() > b.Accesses()
+		}
+		return a.PageIndex < b.PageIndex
+	})
+
+	return report
+}
@@ -0,0 +1,114 @@
+package tinykv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Versioned frames values with a leading schema version byte and
+// upgrades values written with an older schema when they are read.
+type Versioned struct {
+	latest   uint8
+	upgrades map[uint8]func(old []byte) ([]byte, error)
+
+	// RewriteOnRead stores the upgraded form back when Get reads a value
+	// written with an older schema, so each value is upgraded only once.
+	// Read-only databases are never rewritten.
+	RewriteOnRead bool
+}
+
+// NewVersioned returns a Versioned whose current schema is latest.
+func NewVersioned(latest uint8) *Versioned {
+	return &Versioned{
+		latest:   latest,
+		upgrades: make(map[uint8]func(old []byte) ([]byte, error)),
+	}
+}
+
+// RegisterUpgrade registers fn to convert a value from schema version
+// from to version from+1.
+func (v *Versioned) RegisterUpgrade(from uint8, fn func(old []byte) ([]byte, error)) {
+	v.upgrades[from] = fn
+}
+
+// Encode prefixes value with the latest schema version.
+func (v *Versioned) Encode(value []byte) []byte {
+	stored := make([]byte, 0, len(value)+1)
+	stored = append(stored, v.latest)
+	return append(stored, value...)
+}
+
+// Decode strips the schema version from stored and runs every upgrade
+// needed to bring it to the latest version. It also returns the version
+// the value was stored with.
+func (v *Versioned) Decode(stored []byte) ([]byte, uint8, error) {
+	if len(stored) == 0 {
+		return nil, 0, errors.New("versioned value is missing its schema version")
+	}
+
+	version := stored[0]
+	if version > v.latest {
+		return nil, version, fmt.Errorf("value has schema version %d, newer than latest version %d", version, v.latest)
+	}
+
+	value := stored[1:]
+	for current := version; current < v.latest; current++ {
+		upgrade, ok := v.upgrades[current]
+		if !ok {
+			return nil, version, fmt.Errorf("no upgrade registered from schema version %d", current)
+		}
+
+		var err error
+		value, err = upgrade(value)
+		if err != nil {
+			return nil, version, err
+		}
+	}
+
+	return value, version, nil
+}
+
+// Set stores value under key with the latest schema version.
+func (v *Versioned) Set(db *DB, key, value []byte) error {
+	return db.Set(key, v.Encode(value))
+}
+
+// Get returns the value stored under key upgraded to the latest schema
+// version, or nil if the key does not exist.
+func (v *Versioned) Get(db *DB, key []byte) ([]byte, error) {
+	if v.RewriteOnRead && !db.readOnly {
+		var value []byte
+		err := db.UpdateValue(key, func(stored []byte) ([]byte, error) {
+			if stored == nil {
+				return nil, errNoRewrite
+			}
+
+			var version uint8
+			var err error
+			value, version, err = v.Decode(stored)
+			if err != nil {
+				return nil, err
+			}
+			if version == v.latest {
+				return nil, errNoRewrite
+			}
+			return v.Encode(value), nil
+		})
+		if err != nil && err != errNoRewrite {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	stored, err := db.Get(key)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	value, _, err := v.Decode(stored)
+	return value, err
+}
+
+// errNoRewrite aborts the UpdateValue in Get when the stored value is
+// already current.
+var errNoRewrite = errors.New("no rewrite needed")
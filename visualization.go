@@ -3,20 +3,22 @@ package tinykv
 import (
 	"encoding/hex"
 	"fmt"
+	"html"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func visualizeDB(db *DB) error {
-	rootPage := db.bufferPool.pages[0]
-
-	var sb strings.Builder
-	sb.WriteString("digraph G { rank=same; rankdir=\"LR\"; \n")
-	visualizePage(rootPage, 0, &sb)
-	sb.WriteString("}\n")
+	graph, err := visualizeDBDot(db)
+	if err != nil {
+		return err
+	}
 
-	err := os.WriteFile("/tmp/db.dot", []byte(sb.String()), 0600)
+	err = os.WriteFile("/tmp/db.dot", []byte(graph), 0600)
 	if err != nil {
 		return err
 	}
@@ -34,19 +36,46 @@ func visualizeDB(db *DB) error {
 	return nil
 }
 
-func visualizePage(p page, pageIndex uint32, sb *strings.Builder) {
+// visualizeDBDot renders the tree as a graphviz graph.
+func visualizeDBDot(db *DB) (string, error) {
+	// When tracing is enabled, pages are colored by how often they were
+	// accessed
+	var heat *heatMap
+	if db.bufferPool.tracer != nil {
+		heat = newHeatMap(db.bufferPool.tracer.accesses)
+	}
+
+	rootPage, err := db.bufferPool.getPage(db.rootIndex)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("digraph G { rank=same; rankdir=\"LR\"; \n")
+	visualizePage(rootPage, db.rootIndex, heat, &sb)
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+func visualizePage(p page, pageIndex uint32, heat *heatMap, sb *strings.Builder) {
 	switch p.(type) {
 	case *leafPage:
 		leaf := p.(*leafPage)
 		usedBytes := defaultPageSize - leaf.getFreeSpace()
 		label := fmt.Sprintf("Page %d (%d/%d bytes used)", pageIndex, usedBytes, defaultPageSize)
 
+		color := "lightgrey"
+		if heat != nil {
+			label += fmt.Sprintf("\\n%d accesses", heat.accesses[pageIndex])
+			color = heat.color(pageIndex)
+		}
+
 		sb.WriteString(fmt.Sprintf(`	subgraph cluster_p%d {
 		style=filled;
-		color=lightgrey;
+		color="%s";
 		node [style=filled,color=white];
 		label = "%s";
-`, pageIndex, label))
+`, pageIndex, color, label))
 
 		lastNode := ""
 		for iter := leaf.iter(); iter.hasNext(); {
@@ -55,8 +84,8 @@ func visualizePage(p page, pageIndex uint32, sb *strings.Builder) {
 			sb.WriteString(fmt.Sprintf(
 				"		%s [label=\"%s = %s\\noffset = %d\"];\n",
 				keyName,
-				string(cell.key),
-				string(cell.value),
+				dotEscape(displayBytes(cell.key)),
+				dotEscape(displayBytes(cell.value)),
 				cell.offset,
 			))
 			if lastNode != "" {
@@ -68,3 +97,150 @@ func visualizePage(p page, pageIndex uint32, sb *strings.Builder) {
 		sb.WriteString("	}\n")
 	}
 }
+
+// displayBytes renders a key or value for the visualizations. Printable
+// UTF-8 is shown quoted, anything else as hex so binary keys can't
+// garble the output, and empty slices as (empty). The quotes keep a
+// printable key like "0x00ff" or "(empty)" from looking like the others.
+func displayBytes(b []byte) string {
+	if len(b) == 0 {
+		return "(empty)"
+	}
+	if utf8.Valid(b) && strings.IndexFunc(string(b), func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return fmt.Sprintf("%q", b)
+	}
+	return "0x" + hex.EncodeToString(b)
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+type heatMap struct {
+	accesses    map[uint32]int
+	maxAccesses int
+}
+
+// newHeatMap copies accesses, so pages read while rendering don't
+// change the colors halfway through.
+func newHeatMap(accesses map[uint32]int) *heatMap {
+	h := &heatMap{accesses: make(map[uint32]int, len(accesses))}
+	for pageIndex, count := range accesses {
+		h.accesses[pageIndex] = count
+		if count > h.maxAccesses {
+			h.maxAccesses = count
+		}
+	}
+	return h
+}
+
+// color goes from light grey for pages that were never accessed to red
+// for the most accessed page.
+func (h *heatMap) color(pageIndex uint32) string {
+	if h.maxAccesses == 0 {
+		return "#d3d3d3"
+	}
+
+	heat := float64(h.accesses[pageIndex]) / float64(h.maxAccesses)
+	r := 0xd3 + int(heat*float64(0xff-0xd3))
+	gb := 0xd3 - int(heat*float64(0xd3-0x40))
+	return fmt.Sprintf("#%02x%02x%02x", r, gb, gb)
+}
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tinykv</title>
+<style>
+body { font-family: monospace; }
+details { margin-left: 1.5em; }
+summary { cursor: pointer; padding: 2px 4px; background: #d3d3d3; }
+.cell { margin-left: 1.5em; padding: 1px 4px; }
+.cell:hover { background: #eee; }
+</style>
+</head>
+<body>
+`
+
+// visualizeDBHTML renders the tree as a self-contained HTML page with
+// collapsible pages, so it can be viewed without graphviz installed.
+// Hovering a cell shows its offset and sizes. When tracing is enabled,
+// pages are colored by how often they were accessed, like in the dot
+// output.
+func visualizeDBHTML(db *DB, w io.Writer) error {
+	var heat *heatMap
+	if db.bufferPool.tracer != nil {
+		heat = newHeatMap(db.bufferPool.tracer.accesses)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(htmlHeader)
+	err := visualizePageHTML(db, db.rootIndex, heat, &sb)
+	if err != nil {
+		return err
+	}
+	sb.WriteString("</body>\n</html>\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// pageSummaryHTML opens the collapsible section of a page.
+func pageSummaryHTML(pageIndex uint32, heat *heatMap, text string, sb *strings.Builder) {
+	if heat == nil {
+		sb.WriteString(fmt.Sprintf("<details open><summary>%s</summary>\n", text))
+		return
+	}
+	sb.WriteString(fmt.Sprintf("<details open><summary style=\"background: %s\">%s, %d accesses</summary>\n",
+		heat.color(pageIndex), text, heat.accesses[pageIndex]))
+}
+
+func visualizePageHTML(db *DB, pageIndex uint32, heat *heatMap, sb *strings.Builder) error {
+	p, err := db.bufferPool.getPage(pageIndex)
+	if err != nil {
+		return err
+	}
+
+	switch p := p.(type) {
+	case *leafPage:
+		usedBytes := defaultPageSize - p.getFreeSpace()
+		pageSummaryHTML(pageIndex, heat, fmt.Sprintf("Leaf page %d (%d cells, %d/%d bytes used)",
+			pageIndex, p.getNumCells(), usedBytes, defaultPageSize), sb)
+
+		for iter := p.iter(); iter.hasNext(); {
+			cell := iter.next()
+			sb.WriteString(fmt.Sprintf("<div class=\"cell\" title=\"offset = %d, key = %d bytes, value = %d bytes\">%s = %s</div>\n",
+				cell.offset,
+				len(cell.key),
+				len(cell.value),
+				html.EscapeString(displayBytes(cell.key)),
+				html.EscapeString(displayBytes(cell.value)),
+			))
+		}
+
+		sb.WriteString("</details>\n")
+	case *internalPage:
+		usedBytes := defaultPageSize - p.getFreeSpace()
+		pageSummaryHTML(pageIndex, heat, fmt.Sprintf("Internal page %d (%d cells, %d/%d bytes used)",
+			pageIndex, p.getNumCells(), usedBytes, defaultPageSize), sb)
+
+		for iter := p.iter(); iter.hasNext(); {
+			cell := iter.next()
+			err := visualizePageHTML(db, cell.leftChildIndex, heat, sb)
+			if err != nil {
+				return err
+			}
+			sb.WriteString(fmt.Sprintf("<div class=\"cell\" title=\"offset = %d\">&lt; %s</div>\n",
+				cell.offset, html.EscapeString(displayBytes(cell.key))))
+		}
+		err := visualizePageHTML(db, p.getRightChildIndex(), heat, sb)
+		if err != nil {
+			return err
+		}
+
+		sb.WriteString("</details>\n")
+	}
+
+	return nil
+}